@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChannelBroker e um Broker em memoria, dentro do processo. Util em testes e para
+// rodar varios modulos no mesmo binario. As mensagens se perdem se o processo cair.
+type ChannelBroker struct {
+	// Quanto tempo uma mensagem com erro espera antes de voltar para a fila (default 1s),
+	// para uma mensagem que sempre falha nao ocupar o consumidor em loop.
+	RedeliveryDelay time.Duration
+
+	mu     sync.Mutex
+	topics map[string]map[string]*channelQueue
+	lastID int64
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewChannelBroker() *ChannelBroker {
+	return &ChannelBroker{
+		RedeliveryDelay: time.Second,
+		topics:          map[string]map[string]*channelQueue{},
+		closed:          make(chan struct{}),
+	}
+}
+
+func (b *ChannelBroker) Publish(ctx context.Context, topic string, msg Message) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.closed:
+		return "", fmt.Errorf("broker closed")
+	default:
+	}
+
+	b.lastID++
+	msg.ID = strconv.FormatInt(b.lastID, 10)
+	msg.PublishTime = time.Now()
+
+	// sem subscription a mensagem e descartada, como no Pub/Sub
+	for _, queue := range b.topics[topic] {
+		copied := msg
+		copied.Attributes = copyAttributes(msg.Attributes)
+		queue.push(copied)
+	}
+	return msg.ID, nil
+}
+
+func (b *ChannelBroker) CreateSubscription(ctx context.Context, topic string, subscription string) error {
+	b.subscription(topic, subscription)
+	return nil
+}
+
+func (b *ChannelBroker) subscription(topic string, subscription string) *channelQueue {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, found := b.topics[topic]
+	if !found {
+		subs = map[string]*channelQueue{}
+		b.topics[topic] = subs
+	}
+	queue, found := subs[subscription]
+	if !found {
+		queue = newChannelQueue()
+		subs[subscription] = queue
+	}
+	return queue
+}
+
+// Subscribe processa as mensagens uma por vez; mensagens com erro voltam para o fim da fila
+// depois do RedeliveryDelay.
+func (b *ChannelBroker) Subscribe(ctx context.Context, topic string, subscription string, handler MessageHandler) error {
+	queue := b.subscription(topic, subscription)
+
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for {
+		msg, ok := queue.pop(ctx, b.closed)
+		if !ok {
+			return nil
+		}
+		msg.Subscription = subscription
+		msg.DeliveryAttempt++
+
+		if err := callHandler(handlerCtx, handler, msg); err != nil {
+			log.Warn("Subscribe - nack ", topic, subscription, msg.ID, err)
+			b.redeliver(queue, msg)
+		}
+	}
+}
+
+func (b *ChannelBroker) redeliver(queue *channelQueue, msg Message) {
+	if b.RedeliveryDelay <= 0 {
+		queue.push(msg)
+		return
+	}
+	time.AfterFunc(b.RedeliveryDelay, func() {
+		queue.push(msg)
+	})
+}
+
+// Close faz os Subscribe em andamento retornarem e os Publish seguintes falharem.
+func (b *ChannelBroker) Close() {
+	b.once.Do(func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		close(b.closed)
+	})
+}
+
+type channelQueue struct {
+	mu    sync.Mutex
+	items []Message
+	ready chan struct{}
+}
+
+func newChannelQueue() *channelQueue {
+	return &channelQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *channelQueue) push(msg Message) {
+	q.mu.Lock()
+	q.items = append(q.items, msg)
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *channelQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop espera uma mensagem; retorna false se o ctx for cancelado ou o broker fechado.
+func (q *channelQueue) pop(ctx context.Context, closed <-chan struct{}) (Message, bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return Message{}, false
+		case <-closed:
+			return Message{}, false
+		default:
+		}
+
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			msg := q.items[0]
+			q.items = q.items[1:]
+			more := len(q.items) > 0
+			q.mu.Unlock()
+			if more {
+				// acorda os outros consumidores da mesma subscription
+				q.signal()
+			}
+			return msg, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Message{}, false
+		case <-closed:
+			return Message{}, false
+		case <-q.ready:
+		}
+	}
+}
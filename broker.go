@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/option"
+)
+
+// Broker publica e consome lib.Message sem depender do Pub/Sub, para os servicos
+// rodarem tambem on-premise (Redis Streams) e em testes (canais em memoria).
+//
+// Semantica comum a todas as implementacoes:
+//   - cada subscription recebe todas as mensagens publicadas no topico depois de criada;
+//   - consumidores da mesma subscription dividem as mensagens entre si;
+//   - handler retornando erro (ou panic) faz a mensagem ser entregue de novo.
+type Broker interface {
+	// Publish publica a mensagem e retorna o ID dela. ID e PublishTime de msg sao ignorados.
+	Publish(ctx context.Context, topic string, msg Message) (string, error)
+	// CreateSubscription cria a subscription se ela nao existir.
+	CreateSubscription(ctx context.Context, topic string, subscription string) error
+	// Subscribe cria a subscription se precisar e consome ate o ctx ser cancelado.
+	Subscribe(ctx context.Context, topic string, subscription string, handler MessageHandler) error
+	Close()
+}
+
+// OpenBroker escolhe a implementacao pelo esquema da URL:
+//
+//	pubsub://<projeto>[/<topico default>][?credentials=<arquivo json>]
+//	redis://<host:porta>[?env=<ambiente>&pool=<conexoes>&maxlen=<tamanho do stream>]
+//	mem://
+//
+// No pubsub, se PUBSUB_EMULATOR_HOST estiver definido o emulador e usado.
+func OpenBroker(ctx context.Context, rawURL string) (Broker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url: %v", err)
+	}
+	query := u.Query()
+
+	switch u.Scheme {
+	case "pubsub":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing project id in broker url %v", rawURL)
+		}
+		opts := []option.ClientOption{}
+		if credentials := query.Get("credentials"); credentials != "" {
+			opts = append(opts, option.WithCredentialsFile(credentials))
+		}
+		cli, err := NewPubSubClient(ctx, u.Host, strings.Trim(u.Path, "/"), opts...)
+		if err != nil {
+			return nil, err
+		}
+		return NewPubSubBroker(cli), nil
+
+	case "redis":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing host in broker url %v", rawURL)
+		}
+		pool := 10
+		if val := query.Get("pool"); val != "" {
+			if pool, err = strconv.Atoi(val); err != nil {
+				return nil, fmt.Errorf("invalid pool in broker url: %v", err)
+			}
+		}
+		redisClient, err := NewRedisClient(u.Host, query.Get("env"), pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to redis %v: %v", u.Host, err)
+		}
+		broker := NewRedisStreamBroker(redisClient)
+		if val := query.Get("maxlen"); val != "" {
+			if broker.MaxLen, err = strconv.ParseInt(val, 10, 64); err != nil {
+				broker.Close()
+				return nil, fmt.Errorf("invalid maxlen in broker url: %v", err)
+			}
+		}
+		return broker, nil
+
+	case "mem":
+		return NewChannelBroker(), nil
+	}
+	return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+}
+
+// PubSubBroker e o Broker em cima do PubSubClient.
+type PubSubBroker struct {
+	Client *PubSubClient
+	// Configuracao usada nas subscriptions criadas pelo broker.
+	Settings SubscribeSettings
+}
+
+func NewPubSubBroker(cli *PubSubClient) *PubSubBroker {
+	return &PubSubBroker{Client: cli}
+}
+
+func (b *PubSubBroker) Publish(ctx context.Context, topic string, msg Message) (string, error) {
+	result, err := b.Client.publishMessage(ctx, topic, messageToPubSub(msg))
+	if err != nil {
+		return "", err
+	}
+	id, err := result.Get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get: %v", err)
+	}
+	return id, nil
+}
+
+func (b *PubSubBroker) CreateSubscription(ctx context.Context, topic string, subscription string) error {
+	_, err := b.Client.SubscribeWithSettings(topic, subscription, b.Settings)
+	return err
+}
+
+func (b *PubSubBroker) Subscribe(ctx context.Context, topic string, subscription string, handler MessageHandler) error {
+	return b.Client.ConsumeWithSettings(ctx, topic, subscription, b.Settings, handler)
+}
+
+func (b *PubSubBroker) Close() {
+	b.Client.Close()
+}
+
+// copyAttributes evita que publishers e consumidores compartilhem o mesmo map.
+func copyAttributes(attributes map[string]string) map[string]string {
+	if attributes == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(attributes))
+	for key, val := range attributes {
+		ret[key] = val
+	}
+	return ret
+}
@@ -0,0 +1,53 @@
+package brokertest_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	lib "github.com/dev-konfido/go-utils"
+	"github.com/dev-konfido/go-utils/brokertest"
+	"github.com/dev-konfido/go-utils/pubsubtest"
+)
+
+// endereco de um Redis descartavel para testar o RedisStreamBroker; sem ele o teste e pulado
+const redisAddrEnv = "BROKERTEST_REDIS_ADDR"
+
+func TestChannelBroker(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) lib.Broker {
+		broker := lib.NewChannelBroker()
+		broker.RedeliveryDelay = 100 * time.Millisecond
+		return broker
+	})
+}
+
+func TestPubSubBroker(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) lib.Broker {
+		srv, err := pubsubtest.NewServer("proj", "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// o Close do broker fecha o client, o servidor fica para o fim do teste
+		t.Cleanup(func() { srv.Server.Close() })
+		return lib.NewPubSubBroker(srv.Client)
+	})
+}
+
+func TestRedisStreamBroker(t *testing.T) {
+	addr := os.Getenv(redisAddrEnv)
+	if addr == "" {
+		t.Skip(redisAddrEnv + " not set")
+	}
+	brokertest.RunConformance(t, func(t *testing.T) lib.Broker {
+		// os topicos e subscriptions tem nomes unicos, o Redis pode ser compartilhado
+		broker, err := lib.OpenBroker(context.Background(), "redis://"+addr+"?env=brokertest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		redisBroker := broker.(*lib.RedisStreamBroker)
+		redisBroker.RedeliveryDelay = 200 * time.Millisecond
+		redisBroker.BlockTimeout = 100 * time.Millisecond
+		return redisBroker
+	})
+}
@@ -0,0 +1,284 @@
+// Package brokertest tem os testes de conformidade que toda implementacao de lib.Broker
+// precisa passar. Uso, no _test.go da implementacao:
+//
+//	func TestConformance(t *testing.T) {
+//		brokertest.RunConformance(t, func(t *testing.T) lib.Broker {
+//			return lib.NewChannelBroker()
+//		})
+//	}
+package brokertest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lib "github.com/dev-konfido/go-utils"
+)
+
+// Timeout de cada teste. Brokers com reentrega lenta (ex: RedeliveryDelay do
+// RedisStreamBroker) precisam ser configurados com tempos menores que isso.
+var Timeout = 30 * time.Second
+
+// RunConformance roda todos os testes com um broker novo, criado por newBroker, em cada um.
+// O broker e fechado no fim do teste.
+func RunConformance(t *testing.T, newBroker func(t *testing.T) lib.Broker) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, b lib.Broker)
+	}{
+		{"PublishSubscribe", testPublishSubscribe},
+		{"FanOut", testFanOut},
+		{"SharedSubscription", testSharedSubscription},
+		{"Redelivery", testRedelivery},
+		{"CancelStopsSubscribe", testCancelStopsSubscribe},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			b := newBroker(t)
+			defer b.Close()
+			test.run(t, b)
+		})
+	}
+}
+
+// uniqueName evita colisao com topicos e subscriptions de execucoes anteriores.
+func uniqueName(t *testing.T, suffix string) string {
+	name := strings.ToLower(strings.NewReplacer("/", "-", "_", "-").Replace(t.Name()))
+	return fmt.Sprintf("conf-%v-%v-%d", name, suffix, time.Now().UnixNano())
+}
+
+// received guarda as mensagens recebidas por um ou mais Subscribe.
+type received struct {
+	mu   sync.Mutex
+	msgs []lib.Message
+	ch   chan struct{}
+}
+
+func newReceived() *received {
+	return &received{ch: make(chan struct{}, 1)}
+}
+
+func (r *received) add(msg lib.Message) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, msg)
+	r.mu.Unlock()
+	select {
+	case r.ch <- struct{}{}:
+	default:
+	}
+}
+
+func (r *received) byData() map[string][]lib.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := map[string][]lib.Message{}
+	for _, msg := range r.msgs {
+		ret[string(msg.Data)] = append(ret[string(msg.Data)], msg)
+	}
+	return ret
+}
+
+// waitFor espera ate cond ser verdadeira ou o ctx acabar.
+func (r *received) waitFor(ctx context.Context, t *testing.T, cond func(byData map[string][]lib.Message) bool) {
+	t.Helper()
+	for {
+		if cond(r.byData()) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timeout waiting for messages, received %v", len(r.byData()))
+		case <-r.ch:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// subscribe roda o Subscribe em background e retorna uma funcao que espera ele terminar.
+func subscribe(ctx context.Context, t *testing.T, b lib.Broker, topic string, sub string, handler lib.MessageHandler) func() {
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Subscribe(ctx, topic, sub, handler)
+	}()
+	return func() {
+		t.Helper()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Subscribe returned error: %v", err)
+			}
+		case <-time.After(Timeout):
+			t.Errorf("Subscribe did not return after the context was cancelled")
+		}
+	}
+}
+
+func publishN(ctx context.Context, t *testing.T, b lib.Broker, topic string, n int) []string {
+	t.Helper()
+	data := make([]string, n)
+	for i := 0; i < n; i++ {
+		data[i] = fmt.Sprintf("msg-%d", i)
+		msg := lib.Message{
+			Data:       []byte(data[i]),
+			Attributes: map[string]string{"type": "conformance", "seq": fmt.Sprint(i)},
+		}
+		id, err := b.Publish(ctx, topic, msg)
+		if err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		if id == "" {
+			t.Fatalf("Publish returned an empty id")
+		}
+	}
+	return data
+}
+
+func createSubscription(ctx context.Context, t *testing.T, b lib.Broker, topic string, sub string) {
+	t.Helper()
+	if err := b.CreateSubscription(ctx, topic, sub); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	// tem que ser idempotente
+	if err := b.CreateSubscription(ctx, topic, sub); err != nil {
+		t.Fatalf("CreateSubscription (again): %v", err)
+	}
+}
+
+func testPublishSubscribe(t *testing.T, b lib.Broker) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	topic, sub := uniqueName(t, "topic"), uniqueName(t, "sub")
+	createSubscription(ctx, t, b, topic, sub)
+	data := publishN(ctx, t, b, topic, 5)
+
+	recv := newReceived()
+	wait := subscribe(ctx, t, b, topic, sub, func(ctx context.Context, msg lib.Message) error {
+		recv.add(msg)
+		return nil
+	})
+	recv.waitFor(ctx, t, func(byData map[string][]lib.Message) bool {
+		return len(byData) == len(data)
+	})
+	cancel()
+	wait()
+
+	for i, d := range data {
+		msgs := recv.byData()[d]
+		if len(msgs) == 0 {
+			t.Fatalf("message %v not received", d)
+		}
+		msg := msgs[0]
+		if msg.ID == "" {
+			t.Errorf("message %v without ID", d)
+		}
+		if msg.PublishTime.IsZero() {
+			t.Errorf("message %v without PublishTime", d)
+		}
+		if msg.Attributes["type"] != "conformance" || msg.Attributes["seq"] != fmt.Sprint(i) {
+			t.Errorf("message %v with wrong attributes: %v", d, msg.Attributes)
+		}
+	}
+}
+
+func testFanOut(t *testing.T, b lib.Broker) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	topic := uniqueName(t, "topic")
+	subs := []string{uniqueName(t, "sub-a"), uniqueName(t, "sub-b")}
+	for _, sub := range subs {
+		createSubscription(ctx, t, b, topic, sub)
+	}
+	data := publishN(ctx, t, b, topic, 5)
+
+	for _, sub := range subs {
+		subCtx, subCancel := context.WithCancel(ctx)
+		recv := newReceived()
+		wait := subscribe(subCtx, t, b, topic, sub, func(ctx context.Context, msg lib.Message) error {
+			recv.add(msg)
+			return nil
+		})
+		recv.waitFor(ctx, t, func(byData map[string][]lib.Message) bool {
+			return len(byData) == len(data)
+		})
+		subCancel()
+		wait()
+	}
+}
+
+func testSharedSubscription(t *testing.T, b lib.Broker) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	topic, sub := uniqueName(t, "topic"), uniqueName(t, "sub")
+	createSubscription(ctx, t, b, topic, sub)
+	data := publishN(ctx, t, b, topic, 20)
+
+	recv := newReceived()
+	handler := func(ctx context.Context, msg lib.Message) error {
+		recv.add(msg)
+		return nil
+	}
+	wait1 := subscribe(ctx, t, b, topic, sub, handler)
+	wait2 := subscribe(ctx, t, b, topic, sub, handler)
+	recv.waitFor(ctx, t, func(byData map[string][]lib.Message) bool {
+		return len(byData) == len(data)
+	})
+	cancel()
+	wait1()
+	wait2()
+
+	for d, msgs := range recv.byData() {
+		if len(msgs) > 1 {
+			t.Errorf("message %v delivered %v times to the same subscription", d, len(msgs))
+		}
+	}
+}
+
+func testRedelivery(t *testing.T, b lib.Broker) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	topic, sub := uniqueName(t, "topic"), uniqueName(t, "sub")
+	createSubscription(ctx, t, b, topic, sub)
+	data := publishN(ctx, t, b, topic, 2)
+
+	recv := newReceived()
+	wait := subscribe(ctx, t, b, topic, sub, func(ctx context.Context, msg lib.Message) error {
+		recv.add(msg)
+		if string(msg.Data) == data[0] && len(recv.byData()[data[0]]) == 1 {
+			return fmt.Errorf("first delivery fails")
+		}
+		if string(msg.Data) == data[1] && len(recv.byData()[data[1]]) == 1 {
+			panic("first delivery panics")
+		}
+		return nil
+	})
+	recv.waitFor(ctx, t, func(byData map[string][]lib.Message) bool {
+		return len(byData[data[0]]) >= 2 && len(byData[data[1]]) >= 2
+	})
+	cancel()
+	wait()
+}
+
+func testCancelStopsSubscribe(t *testing.T, b lib.Broker) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	topic, sub := uniqueName(t, "topic"), uniqueName(t, "sub")
+	createSubscription(ctx, t, b, topic, sub)
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	wait := subscribe(subCtx, t, b, topic, sub, func(ctx context.Context, msg lib.Message) error {
+		return nil
+	})
+	time.Sleep(100 * time.Millisecond)
+	subCancel()
+	wait()
+}
@@ -0,0 +1,77 @@
+// pubsub-apply cria e atualiza os topicos e subscriptions do projeto conforme o spec
+// (YAML ou JSON), mostrando o plano antes.
+//
+//	pubsub-apply -project p -spec pubsub.yaml -dry-run
+//	pubsub-apply -project p -spec pubsub.yaml
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	lib "github.com/dev-konfido/go-utils"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+)
+
+func main() {
+	project := flag.String("project", "", "projeto do GCP")
+	credentials := flag.String("credentials", "", "arquivo JSON da service account (default: credenciais do ambiente)")
+	specPath := flag.String("spec", "", "arquivo do spec (YAML ou JSON)")
+	dryRun := flag.Bool("dry-run", false, "so mostra o plano, sem aplicar")
+	showUnchanged := flag.Bool("all", false, "mostra tambem o que nao muda")
+	flag.Parse()
+
+	if *project == "" || *specPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*project, *credentials, *specPath, *dryRun, *showUnchanged); err != nil {
+		fmt.Fprintln(os.Stderr, "erro:", err)
+		os.Exit(1)
+	}
+}
+
+func run(project string, credentials string, specPath string, dryRun bool, showUnchanged bool) error {
+	log.SetLevel(log.WarnLevel)
+	ctx := context.Background()
+
+	spec, err := lib.LoadPubSubSpec(specPath)
+	if err != nil {
+		return err
+	}
+
+	opts := []option.ClientOption{}
+	if credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(credentials))
+	}
+	client, err := lib.NewPubSubClient(ctx, project, "", opts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var changes []lib.SpecChange
+	if dryRun {
+		changes, err = client.Plan(ctx, spec)
+	} else {
+		changes, err = client.Apply(ctx, spec)
+	}
+
+	counts := map[string]int{}
+	for _, change := range changes {
+		counts[change.Action]++
+		if change.Action != lib.SpecUnchanged || showUnchanged {
+			fmt.Println(change)
+		}
+	}
+	fmt.Printf("\ncreate=%d update=%d unchanged=%d conflict=%d unmanaged=%d\n",
+		counts[lib.SpecCreate], counts[lib.SpecUpdate], counts[lib.SpecUnchanged], counts[lib.SpecConflict], counts[lib.SpecUnmanaged])
+	if dryRun && err == nil {
+		fmt.Println("dry-run: nada foi aplicado")
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+// pubsub-replay reprocessa mensagens do Pub/Sub: republica uma janela de tempo de um
+// topico em outro, e cria/lista/apaga snapshots e faz seek de subscriptions.
+//
+//	pubsub-replay -project p replay -source events -target events-reprocess -since 3h
+//	pubsub-replay -project p replay -source events -target tmp -from 2022-10-20T10:00:00Z -to 2022-10-20T12:00:00Z
+//	pubsub-replay -project p snapshot -sub events-sink -id before-deploy
+//	pubsub-replay -project p snapshots
+//	pubsub-replay -project p seek -sub events-sink -snapshot before-deploy
+//	pubsub-replay -project p seek -sub events-sink -since 2h
+//	pubsub-replay -project p delete-snapshot -id before-deploy
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	lib "github.com/dev-konfido/go-utils"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+)
+
+func main() {
+	project := flag.String("project", "", "projeto do GCP")
+	credentials := flag.String("credentials", "", "arquivo JSON da service account (default: credenciais do ambiente)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 || *project == "" {
+		usage()
+		os.Exit(2)
+	}
+
+	log.SetLevel(log.WarnLevel)
+	ctx := context.Background()
+
+	opts := []option.ClientOption{}
+	if *credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(*credentials))
+	}
+	client, err := lib.NewPubSubClient(ctx, *project, "", opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "erro:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "replay":
+		err = replay(ctx, client, args)
+	case "snapshot":
+		err = createSnapshot(ctx, client, args)
+	case "snapshots":
+		err = listSnapshots(ctx, client)
+	case "delete-snapshot":
+		err = deleteSnapshot(ctx, client, args)
+	case "seek":
+		err = seek(ctx, client, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "erro:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `uso: pubsub-replay -project p [-credentials file.json] <comando>
+
+comandos:
+  replay -source t -target t (-since 3h | -from ts [-to ts]) [-idle 30s]
+                                          republica a janela de tempo em outro topico
+  snapshot -sub s -id id                  cria snapshot da subscription
+  snapshots                               lista os snapshots
+  delete-snapshot -id id                  apaga o snapshot
+  seek -sub s (-snapshot id | -since 2h | -time ts)
+                                          volta a subscription para o snapshot ou horario
+
+ts no formato RFC3339 (2006-01-02T15:04:05Z)`)
+	flag.PrintDefaults()
+}
+
+// window le -since ou -from/-to; to vazio e agora.
+func window(since time.Duration, from string, to string) (time.Time, time.Time, error) {
+	end := time.Now()
+	if to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("-to invalido: %v", err)
+		}
+		end = t
+	}
+	if since > 0 {
+		return end.Add(-since), end, nil
+	}
+	if from == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("-since ou -from obrigatorio")
+	}
+	start, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("-from invalido: %v", err)
+	}
+	return start, end, nil
+}
+
+func replay(ctx context.Context, client *lib.PubSubClient, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	source := fs.String("source", "", "topico de origem")
+	target := fs.String("target", "", "topico de destino")
+	since := fs.Duration("since", 0, "janela ate agora (ex: 3h)")
+	from := fs.String("from", "", "inicio da janela")
+	to := fs.String("to", "", "fim da janela (default agora)")
+	idle := fs.Duration("idle", 30*time.Second, "para depois desse tempo sem mensagens da janela")
+	fs.Parse(args)
+
+	if *source == "" || *target == "" {
+		return fmt.Errorf("-source e -target obrigatorios")
+	}
+	if *source == *target {
+		return fmt.Errorf("-source e -target precisam ser diferentes")
+	}
+	start, end, err := window(*since, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "republicando %v -> %v de %v ate %v\n", *source, *target, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	count, err := client.Replay(ctx, *source, *target, start, end, *idle)
+	fmt.Printf("%d mensagens republicadas\n", count)
+	return err
+}
+
+func createSnapshot(ctx context.Context, client *lib.PubSubClient, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	sub := fs.String("sub", "", "subscription")
+	id := fs.String("id", "", "nome do snapshot")
+	fs.Parse(args)
+
+	if *sub == "" || *id == "" {
+		return fmt.Errorf("-sub e -id obrigatorios")
+	}
+	info, err := client.CreateSnapshot(ctx, *sub, *id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v (topico %v, expira %v)\n", info.ID, info.Topic, info.Expiration.Format(time.RFC3339))
+	return nil
+}
+
+func listSnapshots(ctx context.Context, client *lib.PubSubClient) error {
+	snapshots, err := client.ListSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for _, info := range snapshots {
+		fmt.Printf("%v\t%v\t%v\n", info.ID, info.Topic, info.Expiration.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func deleteSnapshot(ctx context.Context, client *lib.PubSubClient, args []string) error {
+	fs := flag.NewFlagSet("delete-snapshot", flag.ExitOnError)
+	id := fs.String("id", "", "nome do snapshot")
+	fs.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("-id obrigatorio")
+	}
+	return client.DeleteSnapshot(ctx, *id)
+}
+
+func seek(ctx context.Context, client *lib.PubSubClient, args []string) error {
+	fs := flag.NewFlagSet("seek", flag.ExitOnError)
+	sub := fs.String("sub", "", "subscription")
+	snapshot := fs.String("snapshot", "", "snapshot")
+	since := fs.Duration("since", 0, "volta esse tempo (ex: 2h)")
+	at := fs.String("time", "", "horario")
+	fs.Parse(args)
+
+	if *sub == "" {
+		return fmt.Errorf("-sub obrigatorio")
+	}
+	switch {
+	case *snapshot != "":
+		return client.SeekToSnapshot(ctx, *sub, *snapshot)
+	case *since > 0:
+		return client.SeekToTime(ctx, *sub, time.Now().Add(-*since))
+	case *at != "":
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("-time invalido: %v", err)
+		}
+		return client.SeekToTime(ctx, *sub, t)
+	}
+	return fmt.Errorf("-snapshot, -since ou -time obrigatorio")
+}
@@ -0,0 +1,179 @@
+// redis-inspect mostra estatisticas das chaves do Redis por pattern e
+// exporta/importa chaves (ex: cfg_*) entre ambientes.
+//
+//	redis-inspect -redis host:6379 stats 'cfg_*' 'dev_*'
+//	redis-inspect -redis host:6379 export -pattern 'cfg_*' -out cfg.json
+//	redis-inspect -redis other:6379 import -in cfg.json -dry-run
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	lib "github.com/dev-konfido/go-utils"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	redisHost := flag.String("redis", "localhost:6379", "endereco do redis")
+	env := flag.String("env", "", "ambiente")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	log.SetLevel(log.WarnLevel)
+	client := lib.GetRedisClient(*redisHost, *env, 2)
+	defer client.Close()
+
+	ctx := context.Background()
+	args := flag.Args()[1:]
+
+	var err error
+	switch flag.Arg(0) {
+	case "stats":
+		err = stats(ctx, client, args)
+	case "export":
+		err = export(ctx, client, args)
+	case "import":
+		err = importKeys(ctx, client, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "erro:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `uso: redis-inspect [-redis host:port] [-env env] <comando>
+
+comandos:
+  stats [pattern...]                        chaves, memoria, tipos e TTL por pattern (default cfg_*)
+  export [-pattern cfg_*] [-out file.json]  exporta as chaves para JSON (default stdout)
+  import -in file.json [-dry-run]           importa as chaves mostrando o diff`)
+	flag.PrintDefaults()
+}
+
+func stats(ctx context.Context, client *lib.RedisClient, patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = []string{"cfg_*"}
+	}
+
+	for _, pattern := range patterns {
+		s, err := client.InspectKeys(ctx, pattern)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%v\n  keys: %d\n  memory: %d bytes\n", s.Pattern, s.Keys, s.MemoryBytes)
+		fmt.Printf("  types: %v\n", formatCounts(s.Types))
+		fmt.Printf("  ttl: %v\n", formatCounts(s.TTLBuckets))
+	}
+	return nil
+}
+
+func export(ctx context.Context, client *lib.RedisClient, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	pattern := fs.String("pattern", "cfg_*", "pattern das chaves")
+	out := fs.String("out", "", "arquivo de saida (default stdout)")
+	fs.Parse(args)
+
+	dumps, err := client.DumpKeys(ctx, *pattern)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(dumps, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d chaves exportadas para %v\n", len(dumps), *out)
+	return nil
+}
+
+func importKeys(ctx context.Context, client *lib.RedisClient, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "", "arquivo JSON gerado pelo export")
+	dryRun := fs.Bool("dry-run", false, "so mostra o diff, sem gravar")
+	fs.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("-in obrigatorio")
+	}
+
+	data, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	dumps := []lib.KeyDump{}
+	if err := json.Unmarshal(data, &dumps); err != nil {
+		return fmt.Errorf("invalid dump file: %v", err)
+	}
+
+	diffs, err := client.RestoreKeys(ctx, dumps, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int64{}
+	for _, diff := range diffs {
+		counts[diff.Action]++
+		switch diff.Action {
+		case "create":
+			fmt.Printf("+ %v %v\n", diff.Key, formatValue(diff.New))
+		case "update":
+			fmt.Printf("~ %v %v -> %v\n", diff.Key, formatValue(diff.Old), formatValue(diff.New))
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("dry-run: %v\n", formatCounts(counts))
+	} else {
+		fmt.Printf("importado: %v\n", formatCounts(counts))
+	}
+	return nil
+}
+
+func formatValue(dump *lib.KeyDump) string {
+	if dump.Type == "string" {
+		return fmt.Sprintf("%q", dump.String)
+	}
+	val := *dump
+	val.Key = ""
+	data, _ := json.Marshal(val)
+	return string(data)
+}
+
+func formatCounts(counts map[string]int64) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%v=%d", key, counts[key]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,254 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bsm/redislock"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	IDs estilo Snowflake (int64, ordenados por tempo):
+
+	| 1 bit livre | 41 bits ms desde idEpoch | 10 bits worker | 12 bits sequencia |
+
+	Cada processo aluga um worker ID no Redis (lock com TTL, renovado em background). Se o
+	lease for perdido, um novo worker ID e alugado em background.
+*/
+
+const (
+	idWorkerBits   = 10
+	idSequenceBits = 12
+	idMaxWorker    = 1<<idWorkerBits - 1
+	idMaxSequence  = 1<<idSequenceBits - 1
+
+	// atraso maximo de relogio que esperamos passar antes de retornar erro
+	idMaxClockRollback = 10 * time.Millisecond
+
+	// o lease local termina leaseTTL/10 antes da chave no Redis (diferenca de relogio, latencia)
+	idLeaseMarginDivisor = 10
+)
+
+// 2020-01-01T00:00:00Z
+var idEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	ErrClockMovedBackwards = errors.New("clock moved backwards")
+	ErrWorkerLeaseLost     = errors.New("worker id lease lost")
+)
+
+type IDGenerator struct {
+	mu sync.Mutex
+	// muda se o lease for perdido e outro worker ID for alugado
+	workerID   int64
+	lastMs     int64
+	sequence   int64
+	leaseUntil time.Time
+	leaseTTL   time.Duration
+	lock       *redislock.Lock
+	redis      *RedisClient
+	name       string
+	stop       chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// GetIDGenerator aluga um worker ID livre para o gerador name e mantem o aluguel renovado ate o Close.
+// Se o lease for perdido (ex: Redis fora por mais que o leaseTTL), NextID retorna
+// ErrWorkerLeaseLost ate um novo worker ID ser alugado, o que e tentado em background.
+func (c *RedisClient) GetIDGenerator(ctx context.Context, name string, leaseTTL time.Duration) (*IDGenerator, error) {
+	worker, lock, leaseUntil, err := c.leaseWorkerID(ctx, name, leaseTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	gen := &IDGenerator{
+		workerID:   worker,
+		leaseUntil: leaseUntil,
+		leaseTTL:   leaseTTL,
+		lock:       lock,
+		redis:      c,
+		name:       name,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go gen.renewLease()
+
+	log.Info("IDGenerator ok.", name, worker)
+	return gen, nil
+}
+
+// leaseWorkerID aluga um worker ID livre e retorna ate quando ele pode ser usado.
+func (c *RedisClient) leaseWorkerID(ctx context.Context, name string, leaseTTL time.Duration) (int64, *redislock.Lock, time.Time, error) {
+	// crypto/rand para as replicas nao comecarem todas no mesmo worker (math/rand sem seed)
+	var buf [2]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, nil, time.Time{}, fmt.Errorf("failed to lease worker id: %v", err)
+	}
+	start := int64(binary.BigEndian.Uint16(buf[:])) % (idMaxWorker + 1)
+	for i := int64(0); i <= idMaxWorker; i++ {
+		worker := (start + i) % (idMaxWorker + 1)
+		key := fmt.Sprintf("idgen_%v_%v", name, worker)
+
+		obtained := time.Now()
+		lock, err := c.Locker.Obtain(ctx, key, leaseTTL, nil)
+		if err == redislock.ErrNotObtained {
+			continue
+		} else if err != nil {
+			return 0, nil, time.Time{}, fmt.Errorf("failed to lease worker id: %v", err)
+		}
+		return worker, lock, leaseDeadline(obtained, leaseTTL), nil
+	}
+	return 0, nil, time.Time{}, fmt.Errorf("no worker id available for %v", name)
+}
+
+// leaseDeadline e o fim do lease local, um pouco antes da chave expirar no Redis, para
+// outro processo nunca conseguir o mesmo worker ID enquanto este ainda gera IDs com ele.
+func leaseDeadline(start time.Time, leaseTTL time.Duration) time.Time {
+	return start.Add(leaseTTL - leaseTTL/idLeaseMarginDivisor)
+}
+
+func (g *IDGenerator) renewLease() {
+	defer close(g.done)
+
+	ticker := time.NewTicker(g.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			g.mu.Lock()
+			lock := g.lock
+			g.mu.Unlock()
+
+			if lock == nil {
+				g.reacquireLease()
+				continue
+			}
+
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), g.leaseTTL/3)
+			err := lock.Refresh(ctx, g.leaseTTL, nil)
+			cancel()
+
+			if err == redislock.ErrNotObtained {
+				log.Error("IDGenerator - lease perdido", g.workerID)
+				g.mu.Lock()
+				g.leaseUntil = time.Time{}
+				g.lock = nil
+				g.mu.Unlock()
+				g.reacquireLease()
+				continue
+			} else if err != nil {
+				// tenta de novo no proximo tick, o lease atual continua valendo ate expirar
+				log.Warn("IDGenerator - erro renovando lease", g.workerID, err)
+				continue
+			}
+
+			g.mu.Lock()
+			g.leaseUntil = leaseDeadline(start, g.leaseTTL)
+			g.mu.Unlock()
+		}
+	}
+}
+
+// reacquireLease tenta alugar um novo worker ID; se nao conseguir, tenta no proximo tick.
+func (g *IDGenerator) reacquireLease() {
+	ctx, cancel := context.WithTimeout(context.Background(), g.leaseTTL/3)
+	defer cancel()
+
+	worker, lock, leaseUntil, err := g.redis.leaseWorkerID(ctx, g.name, g.leaseTTL)
+	if err != nil {
+		log.Warn("IDGenerator - erro alugando novo worker id", g.name, err)
+		return
+	}
+
+	g.mu.Lock()
+	g.workerID = worker
+	g.lock = lock
+	g.leaseUntil = leaseUntil
+	g.mu.Unlock()
+	log.Info("IDGenerator - novo worker id", g.name, worker)
+}
+
+// Worker retorna o worker ID atual.
+func (g *IDGenerator) Worker() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.workerID
+}
+
+func (g *IDGenerator) NextID() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if now.After(g.leaseUntil) {
+		return 0, ErrWorkerLeaseLost
+	}
+
+	ms := now.Sub(idEpoch).Milliseconds()
+	if ms < g.lastMs {
+		rollback := time.Duration(g.lastMs-ms) * time.Millisecond
+		if rollback > idMaxClockRollback {
+			return 0, fmt.Errorf("%w by %v", ErrClockMovedBackwards, rollback)
+		}
+		time.Sleep(rollback)
+		ms = g.lastMs
+	}
+
+	if ms == g.lastMs {
+		g.sequence = (g.sequence + 1) & idMaxSequence
+		if g.sequence == 0 {
+			// sequencia esgotada neste ms, espera o proximo
+			for ms <= g.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Since(idEpoch).Milliseconds()
+			}
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastMs = ms
+
+	return ms<<(idWorkerBits+idSequenceBits) | g.workerID<<idSequenceBits | g.sequence, nil
+}
+
+// Close para a renovacao e libera o worker ID. Pode ser chamado mais de uma vez.
+func (g *IDGenerator) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.stop)
+		<-g.done
+
+		g.mu.Lock()
+		lock := g.lock
+		g.leaseUntil = time.Time{}
+		g.mu.Unlock()
+		if lock != nil {
+			g.closeErr = lock.Release(context.Background())
+		}
+	})
+	return g.closeErr
+}
+
+func IDTime(id int64) time.Time {
+	ms := id >> (idWorkerBits + idSequenceBits)
+	return idEpoch.Add(time.Duration(ms) * time.Millisecond)
+}
+
+func IDWorker(id int64) int64 {
+	return (id >> idSequenceBits) & idMaxWorker
+}
+
+func IDSequence(id int64) int64 {
+	return id & idMaxSequence
+}
@@ -0,0 +1,15 @@
+package lib
+
+import "time"
+
+// MetricsRecorder e implementado pelo servico com a lib de metricas que ele usa
+// (Prometheus, OpenCensus, etc).
+type MetricsRecorder interface {
+	ObserveDuration(name string, d time.Duration, labels map[string]string)
+	IncCounter(name string, labels map[string]string)
+}
+
+// GaugeRecorder e opcional, para valores que sobem e descem (ex: tamanho de fila).
+type GaugeRecorder interface {
+	SetGauge(name string, value float64, labels map[string]string)
+}
@@ -0,0 +1,303 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/bsm/redislock"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Transactional outbox: o evento e gravado na tabela de outbox na mesma sql.Tx da
+	alteracao de negocio, e o relay publica no Pub/Sub depois do commit.
+
+	- o relay roda em uma replica so (lock no Redis, renovado enquanto ela for lider);
+	- publica em ordem de id e para no primeiro erro, para nao passar eventos na frente;
+	- a leitura usa READCOMMITTEDLOCK (mesmo com RCSI ligado), entao um id menor ainda sem
+	  commit bloqueia o relay ate o commit/rollback em vez de ser pulado;
+	- a entrega e at-least-once: se cair entre o publish e o UPDATE o evento sai de novo.
+	  O id da linha vai no atributo outbox-id para os consumidores deduplicarem.
+*/
+
+const (
+	DefaultOutboxTable = "dbo.pubsub_outbox"
+
+	OutboxIDAttribute = "outbox-id"
+
+	// linhas apagadas por DELETE no Purge, para nao segurar lock na tabela toda
+	outboxPurgeBatch = 5000
+)
+
+var validOutboxTable = regexp.MustCompile(`^[A-Za-z0-9_.\[\]]+$`)
+
+type Outbox struct {
+	DB *sql.DB
+	// Nome do banco, usado na chave do lock do relay.
+	Database string
+	Table    string
+}
+
+// GetOutbox retorna o outbox de um dos SQLDatabases. Table vazio usa DefaultOutboxTable.
+func (client *MSSQLClient) GetOutbox(database string, table string) (*Outbox, error) {
+	conn, found := client.SQLConns[database]
+	if !found {
+		return nil, fmt.Errorf("unknown database %v", database)
+	}
+	return NewOutbox(conn, database, table)
+}
+
+func NewOutbox(db *sql.DB, database string, table string) (*Outbox, error) {
+	if table == "" {
+		table = DefaultOutboxTable
+	}
+	if !validOutboxTable.MatchString(table) {
+		return nil, fmt.Errorf("invalid outbox table name %q", table)
+	}
+	return &Outbox{DB: db, Database: database, Table: table}, nil
+}
+
+// EnsureTable cria a tabela de outbox se ela nao existir.
+func (o *Outbox) EnsureTable(ctx context.Context) error {
+	query := fmt.Sprintf(`
+		IF OBJECT_ID(N'%[1]v', N'U') IS NULL
+		BEGIN
+			CREATE TABLE %[1]v (
+				id           BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				topic        NVARCHAR(255) NOT NULL,
+				data         VARBINARY(MAX) NOT NULL,
+				attributes   NVARCHAR(MAX) NULL,
+				ordering_key NVARCHAR(255) NULL,
+				created_at   DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+				sent_at      DATETIME2 NULL
+			);
+			CREATE INDEX ix_outbox_pending ON %[1]v (sent_at, id);
+		END`, o.Table)
+	if _, err := o.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create outbox table: %v", err)
+	}
+	return nil
+}
+
+// Add grava o evento na outbox dentro da transacao do chamador. So e publicado
+// se a transacao fizer commit.
+func (o *Outbox) Add(ctx context.Context, tx *sql.Tx, topic string, msg Message) error {
+	var attributes interface{}
+	if len(msg.Attributes) > 0 {
+		encoded, err := json.Marshal(msg.Attributes)
+		if err != nil {
+			return fmt.Errorf("failed to encode attributes: %v", err)
+		}
+		attributes = string(encoded)
+	}
+	var orderingKey interface{}
+	if msg.OrderingKey != "" {
+		orderingKey = msg.OrderingKey
+	}
+	data := msg.Data
+	if data == nil {
+		data = []byte{}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %v (topic, data, attributes, ordering_key) VALUES (@p1, @p2, @p3, @p4)", o.Table)
+	if _, err := tx.ExecContext(ctx, query, topic, data, attributes, orderingKey); err != nil {
+		return fmt.Errorf("failed to insert into outbox: %v", err)
+	}
+	return nil
+}
+
+type outboxRow struct {
+	id          int64
+	topic       string
+	data        []byte
+	attributes  sql.NullString
+	orderingKey sql.NullString
+}
+
+// pending retorna os proximos eventos nao enviados, em ordem de id. Com READCOMMITTEDLOCK a
+// leitura espera as transacoes que ainda vao fazer commit de ids menores, em vez de ler a
+// versao sem elas (RCSI) e publicar um id maior na frente.
+func (o *Outbox) pending(ctx context.Context, limit int) ([]outboxRow, error) {
+	query := fmt.Sprintf("SELECT TOP (@p1) id, topic, data, attributes, ordering_key FROM %v WITH (READCOMMITTEDLOCK) WHERE sent_at IS NULL ORDER BY id", o.Table)
+	rows, err := o.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []outboxRow{}
+	for rows.Next() {
+		row := outboxRow{}
+		if err := rows.Scan(&row.id, &row.topic, &row.data, &row.attributes, &row.orderingKey); err != nil {
+			return nil, fmt.Errorf("failed to read outbox: %v", err)
+		}
+		ret = append(ret, row)
+	}
+	return ret, rows.Err()
+}
+
+func (o *Outbox) markSent(ctx context.Context, id int64) error {
+	query := fmt.Sprintf("UPDATE %v SET sent_at = SYSUTCDATETIME() WHERE id = @p1", o.Table)
+	if _, err := o.DB.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to mark outbox %v as sent: %v", id, err)
+	}
+	return nil
+}
+
+// Purge apaga os eventos enviados ha mais de retention. Retorna quantos apagou.
+func (o *Outbox) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	query := fmt.Sprintf("DELETE TOP (%v) FROM %v WHERE sent_at IS NOT NULL AND sent_at < @p1", outboxPurgeBatch, o.Table)
+	before := time.Now().UTC().Add(-retention)
+
+	var total int64
+	for {
+		result, err := o.DB.ExecContext(ctx, query, before)
+		if err != nil {
+			return total, fmt.Errorf("failed to purge outbox: %v", err)
+		}
+		deleted, _ := result.RowsAffected()
+		total += deleted
+		if deleted < outboxPurgeBatch {
+			return total, nil
+		}
+	}
+}
+
+type OutboxRelay struct {
+	Outbox *Outbox
+	PubSub *PubSubClient
+	Redis  *RedisClient
+
+	BatchSize    int
+	PollInterval time.Duration
+	// TTL do lock de lider; renovado antes de cada batch, que pode levar no maximo LeaseTTL/2.
+	LeaseTTL time.Duration
+	// Eventos enviados sao apagados depois disso (0 nao apaga).
+	Retention     time.Duration
+	PurgeInterval time.Duration
+}
+
+func (o *Outbox) NewRelay(pubsubClient *PubSubClient, redisClient *RedisClient) *OutboxRelay {
+	return &OutboxRelay{
+		Outbox:        o,
+		PubSub:        pubsubClient,
+		Redis:         redisClient,
+		BatchSize:     100,
+		PollInterval:  time.Second,
+		LeaseTTL:      30 * time.Second,
+		Retention:     7 * 24 * time.Hour,
+		PurgeInterval: time.Hour,
+	}
+}
+
+func (r *OutboxRelay) lockKey() string {
+	return fmt.Sprintf("outbox_relay_%v_%v", r.Outbox.Database, r.Outbox.Table)
+}
+
+// Run disputa a lideranca e, enquanto for lider, publica os eventos pendentes.
+// Bloqueia ate o ctx ser cancelado.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		lock, err := r.Redis.Locker.Obtain(ctx, r.lockKey(), r.LeaseTTL, nil)
+		if err == nil {
+			log.Info("Outbox relay - lider ", r.lockKey())
+			r.lead(ctx, lock)
+			lock.Release(context.Background())
+		} else if err != redislock.ErrNotObtained && ctx.Err() == nil {
+			log.Warn("Outbox relay - erro obtendo lock ", r.lockKey(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.PollInterval):
+		}
+	}
+	return nil
+}
+
+// lead roda o relay ate perder o lock ou o ctx ser cancelado. O lock e renovado antes de
+// cada batch e o batch tem no maximo LeaseTTL/2, para o lock nunca expirar no meio de um
+// batch e outra replica virar lider enquanto esta ainda publica.
+func (r *OutboxRelay) lead(ctx context.Context, lock *redislock.Lock) {
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	lastPurge := time.Time{}
+	for {
+		if r.Retention > 0 && time.Since(lastPurge) >= r.PurgeInterval {
+			if deleted, err := r.Outbox.Purge(ctx, r.Retention); err != nil {
+				log.Warn("Outbox relay - ", err)
+			} else {
+				log.Debug("Outbox relay - purge ", deleted)
+			}
+			lastPurge = time.Now()
+		}
+
+		// enquanto tiver batch cheio, continua sem esperar o ticker
+		for ctx.Err() == nil {
+			if err := lock.Refresh(ctx, r.LeaseTTL, nil); err != nil {
+				log.Warn("Outbox relay - lideranca perdida ", r.lockKey(), err)
+				return
+			}
+
+			batchCtx, cancel := context.WithTimeout(ctx, r.LeaseTTL/2)
+			sent, err := r.RelayBatch(batchCtx)
+			cancel()
+			if err != nil {
+				log.Warn("Outbox relay - ", err)
+				break
+			}
+			if sent < r.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayBatch publica um batch de eventos pendentes em ordem e retorna quantos foram enviados.
+// Para no primeiro erro.
+func (r *OutboxRelay) RelayBatch(ctx context.Context) (int, error) {
+	rows, err := r.Outbox.pending(ctx, r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, row := range rows {
+		m := &pubsub.Message{
+			Data:       row.data,
+			Attributes: map[string]string{},
+		}
+		if row.attributes.Valid {
+			if err := json.Unmarshal([]byte(row.attributes.String), &m.Attributes); err != nil {
+				return i, fmt.Errorf("failed to decode attributes of outbox %v: %v", row.id, err)
+			}
+		}
+		m.Attributes[OutboxIDAttribute] = fmt.Sprint(row.id)
+		if row.orderingKey.Valid {
+			m.OrderingKey = row.orderingKey.String
+		}
+
+		result, err := r.PubSub.publishMessage(ctx, row.topic, m)
+		if err != nil {
+			return i, err
+		}
+		if _, err := result.Get(ctx); err != nil {
+			return i, fmt.Errorf("failed to publish outbox %v: %v", row.id, err)
+		}
+		if err := r.Outbox.markSent(ctx, row.id); err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
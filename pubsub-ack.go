@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Com exactly-once delivery (SubscribeSettings.EnableExactlyOnceDelivery) o ack pode
+	falhar, por exemplo se o ack deadline expirou, e a mensagem sera entregue de novo. Por
+	isso o consumo espera o resultado do ack/nack e manda as falhas para o OnAckError e
+	para o contador "pubsub_ack_errors". Sem exactly-once o resultado e sempre sucesso.
+
+	O resultado so chega depois que o client envia o ack, entao a espera e em background
+	para nao segurar o callback do Receive. O claim check so e apagado depois do ack confirmado.
+*/
+
+// quanto esperar os resultados pendentes depois que o Receive termina
+const ackResultTimeout = 10 * time.Second
+
+// pendingAck e um ack ou nack enviado, esperando o resultado.
+type pendingAck struct {
+	msg    Message
+	ack    bool
+	result *pubsub.AckResult
+}
+
+// Nesta versao do pubsub o AckWithResult/NackWithResult sem exactly-once so retorna
+// sucesso, sem fazer o ack. O Ack/Nack depois e no-op quando o ack ja foi feito.
+func ackMessage(m *pubsub.Message, msg Message) pendingAck {
+	result := m.AckWithResult()
+	m.Ack()
+	return pendingAck{msg: msg, ack: true, result: result}
+}
+
+func nackMessage(m *pubsub.Message, msg Message) pendingAck {
+	result := m.NackWithResult()
+	m.Nack()
+	return pendingAck{msg: msg, ack: false, result: result}
+}
+
+// ackWaiter acompanha as goroutines esperando resultados de ack.
+type ackWaiter struct {
+	wg sync.WaitGroup
+}
+
+// waitAcks espera os resultados em background, na ordem, e apaga os claim checks confirmados.
+func (cli *PubSubClient) waitAcks(ctx context.Context, sub *pubsub.Subscription, waiter *ackWaiter, acks ...pendingAck) {
+	waiter.wg.Add(1)
+	go func() {
+		defer waiter.wg.Done()
+		for _, pending := range acks {
+			if cli.waitAck(ctx, sub, pending) && pending.ack {
+				cli.claimCheckAcked(pending.msg)
+			}
+		}
+	}()
+}
+
+// wait espera os resultados pendentes ate o timeout e depois cancela (com cancel) os que faltam.
+func (waiter *ackWaiter) wait(timeout time.Duration, cancel context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		waiter.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		cancel()
+		<-done
+	}
+}
+
+// waitAck espera o resultado e reporta a falha. Retorna true se deu certo.
+func (cli *PubSubClient) waitAck(ctx context.Context, sub *pubsub.Subscription, pending pendingAck) bool {
+	if pending.result == nil {
+		return true
+	}
+	status, err := pending.result.Get(ctx)
+	if err == nil && status == pubsub.AcknowledgeStatusSuccess {
+		return true
+	}
+
+	operation := "ack"
+	if !pending.ack {
+		operation = "nack"
+	}
+	if err == nil {
+		err = fmt.Errorf("%v failed with status %v", operation, ackStatusName(status))
+	} else {
+		err = fmt.Errorf("%v failed: %v", operation, err)
+	}
+	log.Warn("Consume - erro no ", operation, " ", sub.ID(), pending.msg.ID, err)
+
+	if cli.Metrics != nil {
+		cli.Metrics.IncCounter("pubsub_ack_errors", map[string]string{
+			"subscription": sub.ID(),
+			"operation":    operation,
+			"status":       ackStatusName(status),
+		})
+	}
+	if cli.OnAckError != nil {
+		if handlerErr := cli.OnAckError(ctx, pending.msg, err); handlerErr != nil {
+			log.Error("Consume - erro no OnAckError ", sub.ID(), pending.msg.ID, handlerErr)
+		}
+	}
+	return false
+}
+
+func ackStatusName(status pubsub.AcknowledgeStatus) string {
+	switch status {
+	case pubsub.AcknowledgeStatusSuccess:
+		return "success"
+	case pubsub.AcknowledgeStatusPermissionDenied:
+		return "permission_denied"
+	case pubsub.AcknowledgeStatusFailedPrecondition:
+		return "failed_precondition"
+	case pubsub.AcknowledgeStatusInvalidAckID:
+		return "invalid_ack_id"
+	}
+	return "other"
+}
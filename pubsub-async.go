@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetPublishSettings configura batching (CountThreshold, ByteThreshold, DelayThreshold) e
+// flow control (FlowControlSettings) de todos os topicos. Com LimitExceededBehavior =
+// pubsub.FlowControlBlock o publish bloqueia quando o limite de mensagens pendentes e atingido.
+// Precisa ser chamado antes do primeiro publish.
+func (cli *PubSubClient) SetPublishSettings(settings pubsub.PublishSettings) {
+	cli.topicsMu.Lock()
+	defer cli.topicsMu.Unlock()
+
+	cli.PublishSettings = &settings
+	for _, topic := range cli.Topics {
+		topic.PublishSettings = settings
+	}
+}
+
+// PublishAsync publica sem esperar a confirmacao do servidor. A mensagem vai no proximo
+// batch do topico; use result.Get para esperar o ID ou o erro.
+func (cli *PubSubClient) PublishAsync(ctx context.Context, topicName string, msg string, attributes map[string]string) (*pubsub.PublishResult, error) {
+	return cli.publishMessage(ctx, topicName, &pubsub.Message{
+		Data:       []byte(msg),
+		Attributes: attributes,
+	})
+}
+
+func (cli *PubSubClient) publishMessage(ctx context.Context, topicName string, m *pubsub.Message) (*pubsub.PublishResult, error) {
+	topic, err := cli.Topic(ctx, topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := TraceFromContext(ctx); ok {
+		if _, found := m.Attributes[TraceparentAttribute]; !found {
+			// nao altera o map do chamador
+			attributes := copyAttributes(m.Attributes)
+			if attributes == nil {
+				attributes = map[string]string{}
+			}
+			attributes[TraceparentAttribute] = tc.Traceparent()
+			m.Attributes = attributes
+		}
+	}
+
+	if cli.Payload != nil {
+		if err := cli.Payload.encode(m); err != nil {
+			return nil, err
+		}
+	}
+
+	if cli.ClaimCheck != nil {
+		if err := cli.ClaimCheck.store(m); err != nil {
+			return nil, err
+		}
+	}
+
+	cli.inFlight.add()
+	result := topic.Publish(ctx, m)
+	go func() {
+		defer cli.inFlight.done()
+		<-result.Ready()
+		if _, err := result.Get(context.Background()); err != nil && m.OrderingKey != "" {
+			// depois de um erro o pubsub pausa a ordering key ate o ResumePublish
+			log.Warn("Publish - resuming ordering key ", topicName, m.OrderingKey, err)
+			topic.ResumePublish(m.OrderingKey)
+		}
+	}()
+
+	return result, nil
+}
+
+// PublishAsyncWithOrderingKey e o PublishAsync com ordering key. Se o publish falhar,
+// a ordering key e liberada automaticamente para os proximos publishes.
+func (cli *PubSubClient) PublishAsyncWithOrderingKey(ctx context.Context, topicName string, msg string, attributes map[string]string, orderingKey string) (*pubsub.PublishResult, error) {
+	return cli.publishMessage(ctx, topicName, &pubsub.Message{
+		Data:        []byte(msg),
+		Attributes:  attributes,
+		OrderingKey: orderingKey,
+	})
+}
+
+// PublishAsyncWithCallback publica sem bloquear e chama callback com o ID ou o erro
+// quando o servidor responder.
+func (cli *PubSubClient) PublishAsyncWithCallback(ctx context.Context, topicName string, msg string, attributes map[string]string, callback func(id string, err error)) error {
+	result, err := cli.PublishAsync(ctx, topicName, msg, attributes)
+	if err != nil {
+		return err
+	}
+
+	cli.inFlight.add()
+	go func() {
+		defer cli.inFlight.done()
+		id, err := result.Get(context.Background())
+		callback(id, err)
+	}()
+	return nil
+}
+
+// Flush envia os batches pendentes e espera todas as publicacoes (e callbacks) em andamento.
+func (cli *PubSubClient) Flush(ctx context.Context) error {
+	topics := cli.cachedTopics()
+
+	done := make(chan struct{})
+	go func() {
+		for _, topic := range topics {
+			topic.Flush()
+		}
+		<-cli.inFlight.idle()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("flush: %v", ctx.Err())
+	}
+}
+
+// inFlightTracker conta operacoes em andamento. Diferente do sync.WaitGroup,
+// da pra esperar com timeout e adicionar enquanto alguem espera.
+type inFlightTracker struct {
+	mu     sync.Mutex
+	count  int
+	idleCh chan struct{}
+}
+
+func (t *inFlightTracker) add() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.count == 0 {
+		t.idleCh = make(chan struct{})
+	}
+	t.count++
+}
+
+func (t *inFlightTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count--
+	if t.count == 0 {
+		close(t.idleCh)
+	}
+}
+
+// idle retorna um canal que fecha quando nao houver nada em andamento.
+func (t *inFlightTracker) idle() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.count == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	return t.idleCh
+}
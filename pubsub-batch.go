@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchHandler processa um lote de mensagens. Retornar nil faz o ack de todas, um
+// *BatchError faz o nack so das mensagens que ele lista e qualquer outro erro faz o
+// nack do lote inteiro.
+type BatchHandler func(ctx context.Context, msgs []Message) error
+
+// BatchError lista as mensagens do lote que falharam, pelo ID.
+type BatchError struct {
+	Failed map[string]error
+}
+
+func NewBatchError() *BatchError {
+	return &BatchError{Failed: map[string]error{}}
+}
+
+// Fail marca a mensagem para nack.
+func (e *BatchError) Fail(msgID string, err error) {
+	e.Failed[msgID] = err
+}
+
+// Err retorna nil se nenhuma mensagem falhou, para o handler poder terminar com return batchErr.Err().
+func (e *BatchError) Err() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, 0, len(e.Failed))
+	for id, err := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", id, err))
+	}
+	return fmt.Sprintf("%d messages failed: %v", len(e.Failed), strings.Join(msgs, "; "))
+}
+
+type BatchSettings struct {
+	// Tamanho maximo do lote (default 100).
+	MaxMessages int
+	// Quanto tempo esperar o lote encher depois da primeira mensagem (default 1s).
+	MaxWait time.Duration
+}
+
+func (batch BatchSettings) withDefaults() BatchSettings {
+	if batch.MaxMessages <= 0 {
+		batch.MaxMessages = 100
+	}
+	if batch.MaxWait <= 0 {
+		batch.MaxWait = time.Second
+	}
+	return batch
+}
+
+// ConsumeBatch recebe as mensagens da subscription em lotes de ate batch.MaxMessages, ou o que
+// chegar em batch.MaxWait, ate o ctx ser cancelado. Os lotes sao processados um por vez.
+// MaxOutstandingMessages e aumentado para o tamanho do lote se for menor, senao o lote nunca enche.
+func (cli *PubSubClient) ConsumeBatch(ctx context.Context, topicName string, subscriberName string, settings SubscribeSettings, batch BatchSettings, handler BatchHandler) error {
+	batch = batch.withDefaults()
+
+	outstanding := settings.MaxOutstandingMessages
+	if outstanding == 0 {
+		outstanding = pubsub.DefaultReceiveSettings.MaxOutstandingMessages
+	}
+	if outstanding > 0 && outstanding < batch.MaxMessages {
+		log.Warn("ConsumeBatch - MaxOutstandingMessages menor que o lote, usando ", batch.MaxMessages)
+		settings.MaxOutstandingMessages = batch.MaxMessages
+	}
+
+	sub, err := cli.SubscribeWithSettings(topicName, subscriberName, settings)
+	if err != nil {
+		return err
+	}
+
+	// como no receive, os lotes em andamento terminam no shutdown
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msgs := make(chan *pubsub.Message, batch.MaxMessages)
+	done := make(chan struct{})
+	acks := &ackWaiter{}
+	go func() {
+		defer close(done)
+		cli.collectBatches(handlerCtx, sub, msgs, batch, handler, acks)
+	}()
+
+	log.Info("Consuming batches", sub.ID(), batch.MaxMessages, batch.MaxWait)
+	err = sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		msgs <- m
+	})
+	// entrega o ultimo lote incompleto
+	close(msgs)
+	<-done
+	acks.wait(ackResultTimeout, cancel)
+
+	if err != nil {
+		return fmt.Errorf("receive %v: %v", sub.ID(), err)
+	}
+	log.Info("Consume stopped", sub.ID())
+	return nil
+}
+
+func (cli *PubSubClient) collectBatches(ctx context.Context, sub *pubsub.Subscription, msgs <-chan *pubsub.Message, batch BatchSettings, handler BatchHandler, acks *ackWaiter) {
+	pending := make([]*pubsub.Message, 0, batch.MaxMessages)
+	var timeout <-chan time.Time
+
+	flush := func() {
+		if len(pending) > 0 {
+			cli.processBatch(ctx, sub, pending, handler, acks)
+		}
+		pending = make([]*pubsub.Message, 0, batch.MaxMessages)
+		timeout = nil
+	}
+
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				flush()
+				return
+			}
+			pending = append(pending, m)
+			if len(pending) == 1 {
+				timeout = time.After(batch.MaxWait)
+			}
+			if len(pending) >= batch.MaxMessages {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
+
+func (cli *PubSubClient) processBatch(ctx context.Context, sub *pubsub.Subscription, received []*pubsub.Message, handler BatchHandler, acks *ackWaiter) {
+	pending := make([]*pubsub.Message, 0, len(received))
+	batch := make([]Message, 0, len(received))
+	for _, m := range received {
+		msg := messageFromPubSub(m)
+		msg.Subscription = sub.String()
+		if err := cli.decodeMessage(&msg); err != nil {
+			log.Warn("ConsumeBatch - nack ", sub.ID(), m.ID, err)
+			m.Nack()
+			continue
+		}
+		pending = append(pending, m)
+		batch = append(batch, msg)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	err := callBatchHandler(ctx, handler, batch)
+
+	var batchErr *BatchError
+	isBatchErr := errors.As(err, &batchErr)
+	if err != nil && !isBatchErr {
+		log.Warn("ConsumeBatch - nack do lote ", sub.ID(), len(pending), err)
+	}
+
+	results := make([]pendingAck, 0, len(pending))
+	for i, m := range pending {
+		nack := err != nil
+		if isBatchErr {
+			failedErr, failed := batchErr.Failed[m.ID]
+			if failed {
+				log.Warn("ConsumeBatch - nack ", sub.ID(), m.ID, failedErr)
+			}
+			nack = failed
+		}
+		if nack {
+			results = append(results, nackMessage(m, batch[i]))
+		} else {
+			results = append(results, ackMessage(m, batch[i]))
+		}
+	}
+	cli.waitAcks(ctx, sub, acks, results...)
+}
+
+// callBatchHandler chama o handler transformando panic em erro (nack do lote).
+func callBatchHandler(ctx context.Context, handler BatchHandler, msgs []Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("ConsumeBatch - panic ", len(msgs), r, string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, msgs)
+}
@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Claim check: mensagens maiores que o Threshold vao para o storage e so a referencia
+	(atributo claim-check) e publicada. O consumo (Consume, ConsumeWithSettings,
+	ConsumeBatch) busca o conteudo de volta antes de chamar o handler.
+
+	Os arquivos ficam em <Prefix>/<aaaammdd>-<id>. O storage nao tem delete, entao a limpeza
+	move os arquivos para <TrashPrefix>/, que precisa ter expiracao configurada no storage.
+	Com DeleteOnAck sao movidos depois do ack, o que so pode ser ligado se o topico tiver uma
+	subscription so. Senao a limpeza e pelo PurgeClaimChecks, rodando periodicamente com a
+	retention das subscriptions.
+*/
+
+const (
+	ClaimCheckAttribute = "claim-check"
+
+	// limite do Pub/Sub e 10MB por mensagem, incluindo atributos
+	DefaultClaimCheckThreshold = 8 * 1024 * 1024
+	defaultClaimCheckPrefix    = "claimcheck"
+	defaultClaimCheckTrash     = "claimcheck-trash"
+	claimCheckDateLayout       = "20060102"
+)
+
+// BlobStore e onde ficam os payloads grandes. Implementado pelo StorageClient. SaveChecked
+// precisa retornar erro se o arquivo nao foi gravado, senao a referencia publicada aponta
+// para um arquivo que nao existe.
+type BlobStore interface {
+	SaveChecked(path string, content []byte) error
+	Load(path string) ([]byte, error)
+	MoveChecked(pathSource string, pathTarget string) error
+	List(prefix string) []File
+}
+
+type ClaimCheck struct {
+	Store BlobStore
+	// Mensagens com mais bytes que isso vao para o storage (default DefaultClaimCheckThreshold).
+	Threshold int
+	Prefix    string
+	// Para onde os arquivos sao movidos na limpeza; o storage apaga por expiracao.
+	TrashPrefix string
+	DeleteOnAck bool
+}
+
+// EnableClaimCheck liga o claim check no publish e no consumo. threshold 0 usa o default.
+func (cli *PubSubClient) EnableClaimCheck(store BlobStore, threshold int) {
+	if threshold <= 0 {
+		threshold = DefaultClaimCheckThreshold
+	}
+	cli.ClaimCheck = &ClaimCheck{
+		Store:       store,
+		Threshold:   threshold,
+		Prefix:      defaultClaimCheckPrefix,
+		TrashPrefix: defaultClaimCheckTrash,
+	}
+}
+
+func (cc *ClaimCheck) newPath() (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v/%v-%v", cc.Prefix, time.Now().UTC().Format(claimCheckDateLayout), hex.EncodeToString(nonce)), nil
+}
+
+// store troca o Data da mensagem pela referencia quando ela passa do Threshold.
+func (cc *ClaimCheck) store(m *pubsub.Message) error {
+	if len(m.Data) <= cc.Threshold {
+		return nil
+	}
+
+	path, err := cc.newPath()
+	if err != nil {
+		return fmt.Errorf("failed to generate claim check path: %v", err)
+	}
+	if err := cc.Store.SaveChecked(path, m.Data); err != nil {
+		return fmt.Errorf("failed to save claim check: %v", err)
+	}
+
+	// nao altera o map do chamador
+	attributes := copyAttributes(m.Attributes)
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	attributes[ClaimCheckAttribute] = path
+	m.Attributes = attributes
+
+	log.Debug("Claim check ", path, len(m.Data))
+	m.Data = []byte{}
+	return nil
+}
+
+// resolve busca o conteudo de uma mensagem publicada com claim check.
+func (cc *ClaimCheck) resolve(msg *Message) error {
+	path, found := msg.Attributes[ClaimCheckAttribute]
+	if !found {
+		return nil
+	}
+	data, err := cc.Store.Load(path)
+	if err != nil {
+		return fmt.Errorf("failed to load claim check %v: %v", path, err)
+	}
+	msg.Data = data
+	return nil
+}
+
+// discard move o arquivo para o TrashPrefix.
+func (cc *ClaimCheck) discard(path string) error {
+	return cc.Store.MoveChecked(path, cc.TrashPrefix+"/"+filepath.Base(path))
+}
+
+// acked descarta o arquivo depois do ack, se DeleteOnAck estiver ligado.
+func (cc *ClaimCheck) acked(msg Message) {
+	path, found := msg.Attributes[ClaimCheckAttribute]
+	if !found || !cc.DeleteOnAck {
+		return
+	}
+	if err := cc.discard(path); err != nil {
+		// fica para o PurgeClaimChecks
+		log.Warn("Claim check - erro descartando ", path, err)
+	}
+}
+
+// resolveClaimCheck e no-op se o claim check nao estiver ligado. Mensagens com a
+// referencia mas sem claim check configurado geram erro, para nao entregar Data vazio.
+func (cli *PubSubClient) resolveClaimCheck(msg *Message) error {
+	if cli.ClaimCheck == nil {
+		if _, found := msg.Attributes[ClaimCheckAttribute]; found {
+			return fmt.Errorf("message %v has a claim check but claim check is not enabled", msg.ID)
+		}
+		return nil
+	}
+	return cli.ClaimCheck.resolve(msg)
+}
+
+func (cli *PubSubClient) claimCheckAcked(msg Message) {
+	if cli.ClaimCheck != nil {
+		cli.ClaimCheck.acked(msg)
+	}
+}
+
+// PurgeClaimChecks move para o TrashPrefix os arquivos de claim check mais antigos que
+// retention. Uma falha nao para a limpeza dos outros (o arquivo pode ter sido descartado
+// no ack enquanto isso); retorna quantos foram movidos e o ultimo erro.
+func (cli *PubSubClient) PurgeClaimChecks(retention time.Duration) (int, error) {
+	if cli.ClaimCheck == nil {
+		return 0, fmt.Errorf("claim check is not enabled")
+	}
+	cc := cli.ClaimCheck
+	before := time.Now().UTC().Add(-retention)
+
+	moved := 0
+	var lastErr error
+	for _, file := range cc.Store.List(cc.Prefix + "/") {
+		name := filepath.Base(file.Name)
+		if len(name) < len(claimCheckDateLayout) {
+			continue
+		}
+		day, err := time.Parse(claimCheckDateLayout, name[:len(claimCheckDateLayout)])
+		if err != nil {
+			continue
+		}
+		// o dia inteiro precisa estar fora da retention
+		if day.Add(24 * time.Hour).After(before) {
+			continue
+		}
+		if err := cc.discard(cc.Prefix + "/" + name); err != nil {
+			log.Warn("Claim check - erro descartando ", name, err)
+			lastErr = err
+			continue
+		}
+		moved++
+	}
+	return moved, lastErr
+}
@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+	Compressao e assinatura do payload. No publish o Data e comprimido (gzip ou zstd,
+	atributo content-encoding) e assinado com HMAC-SHA256 (atributos signature e key-id).
+	A assinatura cobre o Data como publicado (ja comprimido), o ordering key e os atributos
+	(inclusive type e content-encoding), menos signature, key-id e claim-check. O claim-check
+	e adicionado depois da assinatura, mas o Data buscado no storage e que e verificado.
+
+	No consumo a assinatura e verificada e o Data descomprimido antes do handler. A
+	descompressao nao depende de configuracao; a verificacao precisa do PayloadCodec com a
+	chave do key-id.
+
+	Rotacao de chave: adicionar a chave nova no Keys dos consumidores, depois trocar o
+	SigningKeyID dos publishers e so entao remover a antiga.
+
+	A compressao e feita antes do claim check, entao o que vai para o storage ja esta comprimido.
+*/
+
+const (
+	ContentEncodingAttribute = "content-encoding"
+	SignatureAttribute       = "signature"
+	KeyIDAttribute           = "key-id"
+
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+
+	// protege contra payloads que expandem demais
+	maxDecodedPayload = 256 * 1024 * 1024
+)
+
+type PayloadCodec struct {
+	// Compressao no publish: "" (nenhuma), EncodingGzip ou EncodingZstd.
+	Encoding string
+	// So comprime payloads com pelo menos esse tamanho.
+	MinSize int
+	// Chave usada para assinar no publish. Vazio nao assina.
+	SigningKeyID string
+	// Chaves HMAC por key-id, usadas para assinar e verificar.
+	Keys map[string][]byte
+	// Mensagens sem assinatura recebem nack.
+	RequireSignature bool
+}
+
+// EnablePayloadCodec liga a compressao e/ou assinatura no publish e a verificacao no consumo.
+func (cli *PubSubClient) EnablePayloadCodec(codec *PayloadCodec) error {
+	switch codec.Encoding {
+	case "", EncodingGzip, EncodingZstd:
+	default:
+		return fmt.Errorf("unknown content encoding: %v", codec.Encoding)
+	}
+	if codec.SigningKeyID != "" {
+		if _, found := codec.Keys[codec.SigningKeyID]; !found {
+			return fmt.Errorf("signing key %v not found", codec.SigningKeyID)
+		}
+	}
+	if codec.RequireSignature && len(codec.Keys) == 0 {
+		return fmt.Errorf("signature required but no keys configured")
+	}
+	cli.Payload = codec
+	return nil
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		// os dois sao seguros para uso concorrente com EncodeAll/DecodeAll
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedPayload))
+	})
+}
+
+func compressPayload(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown content encoding: %v", encoding)
+}
+
+func decompressPayload(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedPayload+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded) > maxDecodedPayload {
+			return nil, fmt.Errorf("decoded payload too large")
+		}
+		return decoded, nil
+	case EncodingZstd:
+		initZstd()
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown content encoding: %v", encoding)
+}
+
+// payloadSignature assina os atributos em ordem de chave, o ordering key e o Data. Cada campo
+// vai com o tamanho na frente, para nao haver duas mensagens diferentes com a mesma entrada.
+func payloadSignature(key []byte, attributes map[string]string, orderingKey string, data []byte) []byte {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		switch name {
+		case SignatureAttribute, KeyIDAttribute, ClaimCheckAttribute:
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mac := hmac.New(sha256.New, key)
+	writeSize := func(size int) {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(size))
+		mac.Write(buf[:])
+	}
+	writeField := func(field []byte) {
+		writeSize(len(field))
+		mac.Write(field)
+	}
+	writeSize(len(names))
+	for _, name := range names {
+		writeField([]byte(name))
+		writeField([]byte(attributes[name]))
+	}
+	writeField([]byte(orderingKey))
+	writeField(data)
+	return mac.Sum(nil)
+}
+
+// encode comprime e assina a mensagem. Se o chamador ja definiu o content-encoding o Data
+// nao e comprimido de novo, so assinado. Uma assinatura que ja estiver na mensagem e trocada.
+func (codec *PayloadCodec) encode(m *pubsub.Message) error {
+	data := m.Data
+	encoding, encoded := m.Attributes[ContentEncodingAttribute]
+	if !encoded && codec.Encoding != "" && len(data) >= codec.MinSize {
+		compressed, err := compressPayload(codec.Encoding, data)
+		if err != nil {
+			return fmt.Errorf("failed to compress payload: %v", err)
+		}
+		// nao compensa se nao diminuiu
+		if len(compressed) < len(data) {
+			data = compressed
+			encoding = codec.Encoding
+		}
+	}
+	if codec.SigningKeyID == "" && (encoding == "" || encoded) {
+		return nil
+	}
+
+	// nao altera o map do chamador
+	attributes := copyAttributes(m.Attributes)
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	if encoding != "" {
+		attributes[ContentEncodingAttribute] = encoding
+	}
+	delete(attributes, SignatureAttribute)
+	delete(attributes, KeyIDAttribute)
+	if codec.SigningKeyID != "" {
+		signature := payloadSignature(codec.Keys[codec.SigningKeyID], attributes, m.OrderingKey, data)
+		attributes[SignatureAttribute] = base64.StdEncoding.EncodeToString(signature)
+		attributes[KeyIDAttribute] = codec.SigningKeyID
+	}
+	m.Attributes = attributes
+	m.Data = data
+	return nil
+}
+
+// verify confere a assinatura do Data como foi publicado (antes de descomprimir).
+func (codec *PayloadCodec) verify(msg Message) error {
+	encoded, found := msg.Attributes[SignatureAttribute]
+	if !found {
+		if codec.RequireSignature {
+			return fmt.Errorf("message %v is not signed", msg.ID)
+		}
+		return nil
+	}
+
+	keyID := msg.Attributes[KeyIDAttribute]
+	key, found := codec.Keys[keyID]
+	if !found {
+		return fmt.Errorf("message %v signed with unknown key %v", msg.ID, keyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("message %v has an invalid signature: %v", msg.ID, err)
+	}
+	expected := payloadSignature(key, msg.Attributes, msg.OrderingKey, msg.Data)
+	if !hmac.Equal(signature, expected) {
+		return fmt.Errorf("message %v signature mismatch", msg.ID)
+	}
+	return nil
+}
+
+// decodePayload verifica a assinatura (se o codec estiver ligado) e descomprime o Data.
+// O handler recebe a mensagem sem content-encoding, signature e key-id, que so valem para
+// o Data como foi publicado; assim ela pode ser publicada de novo (ex: ErrorTopicHandler).
+func (cli *PubSubClient) decodePayload(msg *Message) error {
+	if cli.Payload != nil {
+		if err := cli.Payload.verify(*msg); err != nil {
+			return err
+		}
+	}
+
+	encoding, encoded := msg.Attributes[ContentEncodingAttribute]
+	_, signed := msg.Attributes[SignatureAttribute]
+	if !encoded && !signed {
+		return nil
+	}
+	if encoded {
+		data, err := decompressPayload(encoding, msg.Data)
+		if err != nil {
+			return fmt.Errorf("failed to decompress message %v: %v", msg.ID, err)
+		}
+		msg.Data = data
+	}
+
+	attributes := copyAttributes(msg.Attributes)
+	delete(attributes, ContentEncodingAttribute)
+	delete(attributes, SignatureAttribute)
+	delete(attributes, KeyIDAttribute)
+	msg.Attributes = attributes
+	return nil
+}
+
+// decodeMessage busca o claim check e depois verifica/descomprime o payload.
+func (cli *PubSubClient) decodeMessage(msg *Message) error {
+	if err := cli.resolveClaimCheck(msg); err != nil {
+		return err
+	}
+	return cli.decodePayload(msg)
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageHandler processa uma mensagem. Retornar nil faz o ack, retornar erro faz o nack.
+type MessageHandler func(ctx context.Context, msg Message) error
+
+func messageFromPubSub(m *pubsub.Message) Message {
+	msg := Message{
+		ID:          m.ID,
+		Data:        m.Data,
+		Attributes:  m.Attributes,
+		PublishTime: m.PublishTime,
+		OrderingKey: m.OrderingKey,
+	}
+	if m.DeliveryAttempt != nil {
+		msg.DeliveryAttempt = *m.DeliveryAttempt
+	}
+	return msg
+}
+
+func messageToPubSub(msg Message) *pubsub.Message {
+	return &pubsub.Message{
+		Data:        msg.Data,
+		Attributes:  copyAttributes(msg.Attributes),
+		OrderingKey: msg.OrderingKey,
+	}
+}
+
+// Consume recebe as mensagens da subscription ate o ctx ser cancelado.
+// Ao cancelar, para de buscar mensagens novas e espera os handlers em andamento terminarem.
+func (cli *PubSubClient) Consume(ctx context.Context, topicName string, subscriberName string, handler MessageHandler) error {
+	sub, err := cli.Subscribe(topicName, subscriberName, false)
+	if err != nil {
+		return err
+	}
+	return cli.receive(ctx, sub, handler)
+}
+
+// ConsumeWithSettings e o Consume com as configuracoes de subscription e recebimento escolhidas.
+func (cli *PubSubClient) ConsumeWithSettings(ctx context.Context, topicName string, subscriberName string, settings SubscribeSettings, handler MessageHandler) error {
+	sub, err := cli.SubscribeWithSettings(topicName, subscriberName, settings)
+	if err != nil {
+		return err
+	}
+	return cli.receive(ctx, sub, handler)
+}
+
+func (cli *PubSubClient) receive(ctx context.Context, sub *pubsub.Subscription, handler MessageHandler) error {
+	// os handlers nao recebem o ctx do Receive, que e cancelado no shutdown,
+	// para conseguirem terminar o que estao fazendo
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	acks := &ackWaiter{}
+
+	log.Info("Consuming", sub.ID())
+	err := sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		msg := messageFromPubSub(m)
+		msg.Subscription = sub.String()
+		if err := cli.decodeMessage(&msg); err != nil {
+			log.Warn("Consume - nack ", sub.ID(), msg.ID, err)
+			m.Nack()
+			return
+		}
+		if err := callHandler(handlerCtx, handler, msg); err != nil {
+			log.Warn("Consume - nack ", sub.ID(), msg.ID, err)
+			cli.waitAcks(handlerCtx, sub, acks, nackMessage(m, msg))
+			return
+		}
+		cli.waitAcks(handlerCtx, sub, acks, ackMessage(m, msg))
+	})
+	acks.wait(ackResultTimeout, cancel)
+	if err != nil {
+		return fmt.Errorf("receive %v: %v", sub.ID(), err)
+	}
+	log.Info("Consume stopped", sub.ID())
+	return nil
+}
+
+// callHandler chama o handler transformando panic em erro.
+func callHandler(ctx context.Context, handler MessageHandler, msg Message) error {
+	return RecoveryMiddleware()(handler)(ctx, msg)
+}
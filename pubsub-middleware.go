@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Middleware envolve um MessageHandler (log, metricas, etc).
+type Middleware func(next MessageHandler) MessageHandler
+
+// Chain aplica os middlewares no handler. O primeiro da lista e o mais externo.
+func Chain(handler MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// LoggingMiddleware loga cada mensagem processada com campos estruturados
+// (saem como JSON pelo GCEFormatter do GetLogClient).
+func LoggingMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+
+			fields := log.Fields{
+				"messageId":  msg.ID,
+				"type":       msg.Attributes["type"],
+				"durationMs": time.Since(start).Milliseconds(),
+			}
+			if msg.DeliveryAttempt > 0 {
+				fields["deliveryAttempt"] = msg.DeliveryAttempt
+			}
+			if tc, ok := TraceFromContext(ctx); ok {
+				fields["traceId"] = tc.TraceIDString()
+				fields["spanId"] = tc.SpanIDString()
+			}
+
+			if err != nil {
+				log.WithFields(fields).WithError(err).Warn("message failed")
+			} else {
+				log.WithFields(fields).Debug("message processed")
+			}
+			return err
+		}
+	}
+}
+
+// RecoveryMiddleware transforma panic do handler em erro (nack).
+func RecoveryMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("Consume - panic ", msg.ID, r, string(debug.Stack()))
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// MetricsMiddleware registra o tempo de processamento ("pubsub_handler_duration") e o
+// total de mensagens ("pubsub_handler_messages") por type e status (ok/error).
+func MetricsMiddleware(recorder MetricsRecorder) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+
+			status := "ok"
+			if err != nil {
+				status = "error"
+			}
+			labels := map[string]string{
+				"type":   msg.Attributes["type"],
+				"status": status,
+			}
+			recorder.ObserveDuration("pubsub_handler_duration", time.Since(start), labels)
+			recorder.IncCounter("pubsub_handler_messages", labels)
+			return err
+		}
+	}
+}
+
+// TracingMiddleware continua o trace do atributo traceparent da mensagem (ou inicia um
+// novo) e coloca no ctx do handler. Os publishes feitos com esse ctx propagam o trace.
+func TracingMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg Message) error {
+			tc, err := ParseTraceparent(msg.Attributes[TraceparentAttribute])
+			if err != nil {
+				tc = NewTraceContext()
+			} else {
+				tc = tc.NewChild()
+			}
+			return next(ContextWithTrace(ctx, tc), msg)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/idtoken"
+)
+
+// tamanho maximo de uma mensagem do Pub/Sub (10MB) + envelope em base64
+const pushMaxBodyBytes = 16 << 20
+
+// envelope das entregas das subscriptions push
+type pushEnvelope struct {
+	Message         Message `json:"message"`
+	Subscription    string  `json:"subscription"`
+	DeliveryAttempt int     `json:"deliveryAttempt"`
+}
+
+// TokenVerifier valida o bearer token do header Authorization das requisicoes push.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) error
+}
+
+type TokenVerifierFunc func(ctx context.Context, token string) error
+
+func (f TokenVerifierFunc) Verify(ctx context.Context, token string) error {
+	return f(ctx, token)
+}
+
+// GoogleIDTokenVerifier valida o token OIDC que o Pub/Sub envia quando a subscription push
+// tem autenticacao. serviceAccountEmail vazio aceita qualquer service account.
+func GoogleIDTokenVerifier(audience string, serviceAccountEmail string) TokenVerifier {
+	return TokenVerifierFunc(func(ctx context.Context, token string) error {
+		payload, err := idtoken.Validate(ctx, token, audience)
+		if err != nil {
+			return err
+		}
+		if serviceAccountEmail != "" && payload.Claims["email"] != serviceAccountEmail {
+			return fmt.Errorf("unexpected token email %v", payload.Claims["email"])
+		}
+		return nil
+	})
+}
+
+// PushHandler recebe as entregas de uma subscription push e chama o mesmo MessageHandler
+// usado no Consume. Responde 204 (ack) quando o handler retorna nil e 500 (nack) quando
+// retorna erro; envelope invalido retorna 400 e token invalido 401.
+type PushHandler struct {
+	Handler  MessageHandler
+	Verifier TokenVerifier
+	// Opcional. Com ele a mensagem passa pelo claim check e pelo PayloadCodec do client antes
+	// do handler, como no Consume: falha ao buscar o claim check retorna 500 e assinatura
+	// invalida ou payload corrompido retorna 400.
+	Client *PubSubClient
+}
+
+func NewPushHandler(handler MessageHandler, verifier TokenVerifier) *PushHandler {
+	return &PushHandler{
+		Handler:  handler,
+		Verifier: verifier,
+	}
+}
+
+// NewPushHandler cria o PushHandler usando o claim check e o PayloadCodec do client.
+func (cli *PubSubClient) NewPushHandler(handler MessageHandler, verifier TokenVerifier) *PushHandler {
+	return &PushHandler{
+		Handler:  handler,
+		Verifier: verifier,
+		Client:   cli,
+	}
+}
+
+func (h *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.Verifier != nil {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		if err := h.Verifier.Verify(r.Context(), strings.TrimPrefix(auth, "Bearer ")); err != nil {
+			log.Warn("Push - token invalido ", err)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, pushMaxBodyBytes))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := ParsePushEnvelope(body)
+	if err != nil {
+		log.Warn("Push - envelope invalido ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.Client != nil {
+		if err := h.Client.resolveClaimCheck(&msg); err != nil {
+			log.Warn("Push - nack ", msg.Subscription, msg.ID, err)
+			http.Error(w, "failed to load claim check", http.StatusInternalServerError)
+			return
+		}
+		if err := h.Client.decodePayload(&msg); err != nil {
+			log.Warn("Push - payload invalido ", msg.Subscription, msg.ID, err)
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := callHandler(r.Context(), h.Handler, msg); err != nil {
+		log.Warn("Push - nack ", msg.Subscription, msg.ID, err)
+		http.Error(w, "handler failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	if h.Client != nil {
+		h.Client.claimCheckAcked(msg)
+	}
+}
+
+// ParsePushEnvelope decodifica o corpo de uma entrega push.
+func ParsePushEnvelope(body []byte) (Message, error) {
+	envelope := pushEnvelope{}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return Message{}, fmt.Errorf("invalid push envelope: %v", err)
+	}
+	if envelope.Message.ID == "" {
+		return Message{}, fmt.Errorf("invalid push envelope: missing messageId")
+	}
+
+	msg := envelope.Message
+	msg.Subscription = envelope.Subscription
+	msg.DeliveryAttempt = envelope.DeliveryAttempt
+	if msg.Attributes == nil {
+		msg.Attributes = map[string]string{}
+	}
+	return msg, nil
+}
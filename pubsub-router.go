@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// O que fazer com mensagens de um type sem handler (e sem Fallback).
+type UnknownTypePolicy int
+
+const (
+	// descarta a mensagem (ack)
+	UnknownTypeAck UnknownTypePolicy = iota
+	// devolve a mensagem (nack), para outro consumidor tratar
+	UnknownTypeNack
+	// manda para o OnError do router
+	UnknownTypeError
+)
+
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+type route struct {
+	handler     MessageHandler
+	middlewares []Middleware
+}
+
+// Router despacha as mensagens pelo atributo "type" (ver PublishWithAttribs).
+type Router struct {
+	UnknownTypePolicy UnknownTypePolicy
+	OnError           ErrorHandler
+
+	mu          sync.RWMutex
+	routes      map[string]route
+	fallback    *route
+	middlewares []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes: map[string]route{},
+	}
+}
+
+// Use adiciona middlewares aplicados em todas as rotas, antes dos middlewares da rota.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+func (r *Router) Handle(msgType string, handler MessageHandler, middlewares ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[msgType] = route{handler: handler, middlewares: middlewares}
+}
+
+// Fallback recebe as mensagens de types sem handler registrado.
+func (r *Router) Fallback(handler MessageHandler, middlewares ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = &route{handler: handler, middlewares: middlewares}
+}
+
+// Types retorna os types com handler registrado.
+func (r *Router) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]string, 0, len(r.routes))
+	for msgType := range r.routes {
+		ret = append(ret, msgType)
+	}
+	return ret
+}
+
+// HandleMessage e um MessageHandler, pode ser passado direto para o Consume.
+func (r *Router) HandleMessage(ctx context.Context, msg Message) error {
+	msgType := msg.Attributes["type"]
+
+	r.mu.RLock()
+	rt, found := r.routes[msgType]
+	if !found && r.fallback != nil {
+		rt, found = *r.fallback, true
+	}
+	middlewares := r.middlewares
+	r.mu.RUnlock()
+
+	if !found {
+		return r.handleUnknown(ctx, msg, msgType)
+	}
+
+	handler := Chain(rt.handler, rt.middlewares...)
+	return Chain(handler, middlewares...)(ctx, msg)
+}
+
+func (r *Router) handleUnknown(ctx context.Context, msg Message, msgType string) error {
+	err := fmt.Errorf("%w: %q", ErrUnknownMessageType, msgType)
+	switch r.UnknownTypePolicy {
+	case UnknownTypeNack:
+		return err
+	case UnknownTypeError:
+		if r.OnError != nil {
+			return r.OnError(ctx, msg, err)
+		}
+		return err
+	default:
+		log.Debug("Router - descartando ", msg.ID, err)
+		return nil
+	}
+}
+
+func typeFilter(msgType string) string {
+	return fmt.Sprintf("attributes.type = %q", msgType)
+}
+
+// RouteSubscriptionName e o nome da subscription criada pelo ConsumeRoutes para o type.
+func RouteSubscriptionName(prefix string, msgType string) string {
+	return fmt.Sprintf("%v-%v", prefix, msgType)
+}
+
+// ConsumeRoutes cria uma subscription por type registrado, com filtro no servidor por
+// attributes.type, e consome todas ate o ctx ser cancelado. O Fallback nao e usado aqui.
+func (r *Router) ConsumeRoutes(ctx context.Context, cli *PubSubClient, topicName string, subscriptionPrefix string, settings SubscribeSettings) error {
+	types := r.Types()
+	if len(types) == 0 {
+		return fmt.Errorf("router has no routes")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(types))
+	for _, msgType := range types {
+		subSettings := settings
+		subSettings.Filter = typeFilter(msgType)
+		subName := RouteSubscriptionName(subscriptionPrefix, msgType)
+
+		go func() {
+			err := cli.ConsumeWithSettings(ctx, topicName, subName, subSettings, r.HandleMessage)
+			if err != nil {
+				// se uma parar com erro, para todas
+				cancel()
+			}
+			errs <- err
+		}()
+	}
+
+	var firstErr error
+	for range types {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+)
+
+// atributo com o ID original nas mensagens republicadas pelo Replay
+const ReplayOfAttribute = "replay-of"
+
+// idleTimeout do Replay quando nao informado
+const defaultReplayIdleTimeout = 30 * time.Second
+
+type SnapshotInfo struct {
+	ID         string    `json:"id"`
+	Topic      string    `json:"topic"`
+	Expiration time.Time `json:"expiration"`
+}
+
+func snapshotInfo(cfg *pubsub.SnapshotConfig) SnapshotInfo {
+	info := SnapshotInfo{ID: cfg.ID(), Expiration: cfg.Expiration}
+	if cfg.Topic != nil {
+		info.Topic = cfg.Topic.ID()
+	}
+	return info
+}
+
+// CreateSnapshot guarda o estado de ack da subscription (mensagens nao confirmadas e as
+// publicadas depois) para voltar nele com SeekToSnapshot, ex: antes de um deploy.
+func (cli *PubSubClient) CreateSnapshot(ctx context.Context, subscriberName string, snapshotID string) (SnapshotInfo, error) {
+	cfg, err := cli.ServerClient.Subscription(subscriberName).CreateSnapshot(ctx, snapshotID)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to create snapshot %v: %v", snapshotID, err)
+	}
+	log.Info("Snapshot created", subscriberName, snapshotID)
+	return snapshotInfo(cfg), nil
+}
+
+func (cli *PubSubClient) ListSnapshots(ctx context.Context) ([]SnapshotInfo, error) {
+	ret := []SnapshotInfo{}
+	it := cli.ServerClient.Snapshots(ctx)
+	for {
+		cfg, err := it.Next()
+		if err == iterator.Done {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots: %v", err)
+		}
+		ret = append(ret, snapshotInfo(cfg))
+	}
+}
+
+func (cli *PubSubClient) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	if err := cli.ServerClient.Snapshot(snapshotID).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete snapshot %v: %v", snapshotID, err)
+	}
+	return nil
+}
+
+// SeekToSnapshot volta a subscription para o estado do snapshot: o que estava pendente
+// nele e entregue de novo.
+func (cli *PubSubClient) SeekToSnapshot(ctx context.Context, subscriberName string, snapshotID string) error {
+	sub := cli.ServerClient.Subscription(subscriberName)
+	if err := sub.SeekToSnapshot(ctx, cli.ServerClient.Snapshot(snapshotID)); err != nil {
+		return fmt.Errorf("failed to seek %v to snapshot %v: %v", subscriberName, snapshotID, err)
+	}
+	log.Info("Subscription seeked to snapshot", subscriberName, snapshotID)
+	return nil
+}
+
+// SeekToTime marca como nao confirmadas as mensagens publicadas depois de t (e como
+// confirmadas as anteriores). So volta ate onde a subscription ou o topico retem mensagens:
+// RetainAckedMessages na subscription ou retention configurada no topico.
+func (cli *PubSubClient) SeekToTime(ctx context.Context, subscriberName string, t time.Time) error {
+	sub := cli.ServerClient.Subscription(subscriberName)
+	if err := sub.SeekToTime(ctx, t); err != nil {
+		return fmt.Errorf("failed to seek %v to %v: %v", subscriberName, t, err)
+	}
+	log.Info("Subscription seeked to time", subscriberName, t)
+	return nil
+}
+
+// Replay republica em targetTopic as mensagens de sourceTopic publicadas entre from e to.
+// Cria uma subscription temporaria no topico de origem, volta ela para from e consome ate
+// ficar idleTimeout sem receber mensagens da janela. A subscription e apagada no fim (e
+// expira sozinha em 1 dia se o processo morrer). Precisa de retention configurada no
+// topico de origem cobrindo from. Retorna quantas mensagens foram republicadas.
+// idleTimeout <= 0 usa 30s. O topico de origem precisa existir, nunca e criado.
+func (cli *PubSubClient) Replay(ctx context.Context, sourceTopic string, targetTopic string, from time.Time, to time.Time, idleTimeout time.Duration) (int, error) {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultReplayIdleTimeout
+	}
+	idleCheck := idleTimeout / 10
+	if idleCheck < time.Millisecond {
+		idleCheck = time.Millisecond
+	}
+
+	// com create=false um -source errado da erro em vez de criar um topico vazio; o
+	// SubscribeWithSettings encontra o topico no cache
+	if _, err := cli.getTopic(ctx, sourceTopic, false); err != nil {
+		return 0, err
+	}
+
+	subscriberName := fmt.Sprintf("replay-%v-%d", sourceTopic, time.Now().Unix())
+	sub, err := cli.SubscribeWithSettings(sourceTopic, subscriberName, SubscribeSettings{
+		MaxOutstandingMessages: 100,
+		ExpirationPolicy:       24 * time.Hour,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := sub.Delete(context.Background()); err != nil {
+			log.Warn("Replay - erro apagando subscription ", subscriberName, err)
+		}
+	}()
+
+	if err := cli.SeekToTime(ctx, subscriberName, from); err != nil {
+		return 0, err
+	}
+
+	var mu sync.Mutex
+	count := 0
+	lastMessage := time.Now()
+
+	receiveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(idleCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-receiveCtx.Done():
+				return
+			case <-ticker.C:
+				mu.Lock()
+				idle := time.Since(lastMessage) >= idleTimeout
+				mu.Unlock()
+				if idle {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	log.Info("Replaying", sourceTopic, targetTopic, from, to)
+	var publishErr error
+	err = sub.Receive(receiveCtx, func(_ context.Context, m *pubsub.Message) {
+		if m.PublishTime.Before(from) || m.PublishTime.After(to) {
+			m.Ack()
+			return
+		}
+
+		replayed := messageToPubSub(messageFromPubSub(m))
+		if replayed.Attributes == nil {
+			replayed.Attributes = map[string]string{}
+		}
+		replayed.Attributes[ReplayOfAttribute] = m.ID
+
+		result, err := cli.publishMessage(ctx, targetTopic, replayed)
+		if err == nil {
+			_, err = result.Get(ctx)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			// para no primeiro erro; a mensagem fica pendente na subscription temporaria
+			publishErr = fmt.Errorf("failed to republish %v: %v", m.ID, err)
+			m.Nack()
+			cancel()
+			return
+		}
+		m.Ack()
+		count++
+		lastMessage = time.Now()
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if publishErr != nil {
+		return count, publishErr
+	}
+	if err != nil {
+		return count, fmt.Errorf("receive %v: %v", subscriberName, err)
+	}
+	log.Info("Replay done", sourceTopic, targetTopic, count)
+	return count, nil
+}
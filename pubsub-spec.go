@@ -0,0 +1,508 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	Provisionamento declarativo: o spec (YAML ou JSON) lista os topicos e subscriptions do
+	projeto e o Apply cria ou atualiza o que estiver diferente. Nada e apagado: o que existe
+	no projeto e nao esta no spec aparece no plano como "unmanaged".
+
+	topics:
+	  - name: events
+	    messageRetention: 24h
+	subscriptions:
+	  - name: events-sink
+	    topic: events
+	    ackDeadline: 30s
+	    filter: attributes.type = "position"
+	    deadLetterTopic: events-dlq
+	    maxDeliveryAttempts: 10
+	    expirationPolicy: never
+
+	Campos omitidos nao sao gerenciados (ficam como estao no servidor). Topic, filter e
+	enableMessageOrdering nao podem ser alterados numa subscription existente; diferenca
+	nesses campos aparece como "conflict" e o Apply nao faz nada ate ela ser recriada.
+*/
+
+// SpecDuration e uma duracao no formato do time.ParseDuration ("30s", "24h"),
+// ou "never" no expirationPolicy.
+type SpecDuration time.Duration
+
+func (d *SpecDuration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	if s == "never" {
+		*d = SpecDuration(NeverExpire)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %v: %v", node.Line, err)
+	}
+	*d = SpecDuration(parsed)
+	return nil
+}
+
+func (d SpecDuration) String() string {
+	if time.Duration(d) == NeverExpire {
+		return "never"
+	}
+	return time.Duration(d).String()
+}
+
+type TopicSpec struct {
+	Name             string       `yaml:"name"`
+	MessageRetention SpecDuration `yaml:"messageRetention,omitempty"`
+}
+
+type SubscriptionSpec struct {
+	Name                  string       `yaml:"name"`
+	Topic                 string       `yaml:"topic"`
+	AckDeadline           SpecDuration `yaml:"ackDeadline,omitempty"`
+	RetentionDuration     SpecDuration `yaml:"retentionDuration,omitempty"`
+	RetainAckedMessages   *bool        `yaml:"retainAckedMessages,omitempty"`
+	ExpirationPolicy      SpecDuration `yaml:"expirationPolicy,omitempty"`
+	Filter                string       `yaml:"filter,omitempty"`
+	EnableMessageOrdering bool         `yaml:"enableMessageOrdering,omitempty"`
+	// Diferente dos outros bools, false desliga na subscription existente.
+	EnableExactlyOnceDelivery bool         `yaml:"enableExactlyOnceDelivery,omitempty"`
+	DeadLetterTopic           string       `yaml:"deadLetterTopic,omitempty"`
+	MaxDeliveryAttempts       int          `yaml:"maxDeliveryAttempts,omitempty"`
+	MinRetryBackoff           SpecDuration `yaml:"minRetryBackoff,omitempty"`
+	MaxRetryBackoff           SpecDuration `yaml:"maxRetryBackoff,omitempty"`
+}
+
+type PubSubSpec struct {
+	Topics        []TopicSpec        `yaml:"topics"`
+	Subscriptions []SubscriptionSpec `yaml:"subscriptions"`
+}
+
+// settings converte para o SubscribeSettings, para usar a mesma logica do SubscribeWithSettings.
+func (s SubscriptionSpec) settings() SubscribeSettings {
+	return SubscribeSettings{
+		AckDeadline:               time.Duration(s.AckDeadline),
+		RetentionDuration:         time.Duration(s.RetentionDuration),
+		ExpirationPolicy:          time.Duration(s.ExpirationPolicy),
+		Filter:                    s.Filter,
+		EnableMessageOrdering:     s.EnableMessageOrdering,
+		EnableExactlyOnceDelivery: s.EnableExactlyOnceDelivery,
+		DeadLetterTopic:           s.DeadLetterTopic,
+		MaxDeliveryAttempts:       s.MaxDeliveryAttempts,
+		MinRetryBackoff:           time.Duration(s.MinRetryBackoff),
+		MaxRetryBackoff:           time.Duration(s.MaxRetryBackoff),
+	}
+}
+
+// ParsePubSubSpec le o spec em YAML ou JSON. Campos desconhecidos sao erro.
+func ParsePubSubSpec(data []byte) (PubSubSpec, error) {
+	spec := PubSubSpec{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&spec); err != nil {
+		return spec, fmt.Errorf("invalid pubsub spec: %v", err)
+	}
+	return spec, spec.Validate()
+}
+
+func LoadPubSubSpec(path string) (PubSubSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PubSubSpec{}, fmt.Errorf("failed to read pubsub spec: %v", err)
+	}
+	return ParsePubSubSpec(data)
+}
+
+func (spec PubSubSpec) Validate() error {
+	topics := map[string]bool{}
+	for _, topic := range spec.Topics {
+		if topic.Name == "" {
+			return fmt.Errorf("topic without name")
+		}
+		if topics[topic.Name] {
+			return fmt.Errorf("duplicated topic %v", topic.Name)
+		}
+		if topic.MessageRetention < 0 {
+			return fmt.Errorf("topic %v: invalid messageRetention", topic.Name)
+		}
+		topics[topic.Name] = true
+	}
+
+	subs := map[string]bool{}
+	for _, sub := range spec.Subscriptions {
+		if sub.Name == "" || sub.Topic == "" {
+			return fmt.Errorf("subscription without name or topic")
+		}
+		if subs[sub.Name] {
+			return fmt.Errorf("duplicated subscription %v", sub.Name)
+		}
+		if sub.AckDeadline < 0 || sub.RetentionDuration < 0 || sub.MinRetryBackoff < 0 || sub.MaxRetryBackoff < 0 {
+			return fmt.Errorf("subscription %v: only expirationPolicy accepts never", sub.Name)
+		}
+		if sub.MaxDeliveryAttempts != 0 && sub.DeadLetterTopic == "" {
+			return fmt.Errorf("subscription %v: maxDeliveryAttempts without deadLetterTopic", sub.Name)
+		}
+		subs[sub.Name] = true
+	}
+	return nil
+}
+
+const (
+	SpecCreate    = "create"
+	SpecUpdate    = "update"
+	SpecUnchanged = "unchanged"
+	SpecConflict  = "conflict"
+	SpecUnmanaged = "unmanaged"
+)
+
+// SpecChange e um item do plano. Diff tem uma linha "campo: atual -> desejado" por campo.
+type SpecChange struct {
+	Kind   string   `json:"kind"` // topic, subscription
+	Name   string   `json:"name"`
+	Action string   `json:"action"`
+	Diff   []string `json:"diff,omitempty"`
+
+	topicUpdate *pubsub.TopicConfigToUpdate
+	subUpdate   *pubsub.SubscriptionConfigToUpdate
+}
+
+func (c SpecChange) String() string {
+	prefix := map[string]string{
+		SpecCreate:    "+",
+		SpecUpdate:    "~",
+		SpecUnchanged: "=",
+		SpecConflict:  "!",
+		SpecUnmanaged: "?",
+	}[c.Action]
+
+	lines := []string{fmt.Sprintf("%v %v %v (%v)", prefix, c.Kind, c.Name, c.Action)}
+	for _, diff := range c.Diff {
+		lines = append(lines, "    "+diff)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Plan compara o spec com o projeto, sem alterar nada.
+func (cli *PubSubClient) Plan(ctx context.Context, spec PubSubSpec) ([]SpecChange, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	changes := []SpecChange{}
+	managedTopics := map[string]bool{}
+	for _, topicSpec := range spec.Topics {
+		change, err := cli.planTopic(ctx, topicSpec)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+		managedTopics[topicSpec.Name] = true
+	}
+
+	managedSubs := map[string]bool{}
+	for _, subSpec := range spec.Subscriptions {
+		for _, topicName := range []string{subSpec.Topic, subSpec.DeadLetterTopic} {
+			if topicName == "" || managedTopics[topicName] {
+				continue
+			}
+			exists, err := cli.ServerClient.Topic(topicName).Exists(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check if topic %v exists: %v", topicName, err)
+			}
+			if !exists {
+				return nil, fmt.Errorf("subscription %v: topic %v is not in the spec and does not exist", subSpec.Name, topicName)
+			}
+		}
+
+		change, err := cli.planSubscription(ctx, subSpec)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+		managedSubs[subSpec.Name] = true
+	}
+
+	unmanaged, err := cli.unmanaged(ctx, managedTopics, managedSubs)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, unmanaged...), nil
+}
+
+func (cli *PubSubClient) planTopic(ctx context.Context, spec TopicSpec) (SpecChange, error) {
+	change := SpecChange{Kind: "topic", Name: spec.Name}
+
+	topic := cli.ServerClient.Topic(spec.Name)
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return change, fmt.Errorf("failed to check if topic %v exists: %v", spec.Name, err)
+	}
+	if !exists {
+		change.Action = SpecCreate
+		if spec.MessageRetention != 0 {
+			change.Diff = append(change.Diff, fmt.Sprintf("messageRetention: %v", spec.MessageRetention))
+		}
+		return change, nil
+	}
+
+	cfg, err := topic.Config(ctx)
+	if err != nil {
+		return change, fmt.Errorf("failed to get topic %v config: %v", spec.Name, err)
+	}
+
+	change.Action = SpecUnchanged
+	if spec.MessageRetention != 0 {
+		current, _ := cfg.RetentionDuration.(time.Duration)
+		if current != time.Duration(spec.MessageRetention) {
+			change.Action = SpecUpdate
+			change.Diff = append(change.Diff, fmt.Sprintf("messageRetention: %v -> %v", current, spec.MessageRetention))
+			change.topicUpdate = &pubsub.TopicConfigToUpdate{RetentionDuration: time.Duration(spec.MessageRetention)}
+		}
+	}
+	return change, nil
+}
+
+func (cli *PubSubClient) planSubscription(ctx context.Context, spec SubscriptionSpec) (SpecChange, error) {
+	change := SpecChange{Kind: "subscription", Name: spec.Name}
+	settings := spec.settings()
+
+	sub := cli.ServerClient.Subscription(spec.Name)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return change, fmt.Errorf("failed to check if sub %v exists: %v", spec.Name, err)
+	}
+	if !exists {
+		change.Action = SpecCreate
+		change.Diff = append(change.Diff, fmt.Sprintf("topic: %v", spec.Topic))
+		if spec.Filter != "" {
+			change.Diff = append(change.Diff, fmt.Sprintf("filter: %v", spec.Filter))
+		}
+		if spec.DeadLetterTopic != "" {
+			change.Diff = append(change.Diff, fmt.Sprintf("deadLetterTopic: %v", spec.DeadLetterTopic))
+		}
+		if spec.EnableExactlyOnceDelivery {
+			change.Diff = append(change.Diff, "enableExactlyOnceDelivery: true")
+		}
+		return change, nil
+	}
+
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		return change, fmt.Errorf("failed to get sub %v config: %v", spec.Name, err)
+	}
+
+	// campos que so valem na criacao
+	conflicts := []string{}
+	if cfg.Topic != nil && cfg.Topic.ID() != spec.Topic {
+		conflicts = append(conflicts, fmt.Sprintf("topic: %v -> %v", cfg.Topic.ID(), spec.Topic))
+	}
+	if cfg.Filter != spec.Filter {
+		conflicts = append(conflicts, fmt.Sprintf("filter: %q -> %q", cfg.Filter, spec.Filter))
+	}
+	if cfg.EnableMessageOrdering != spec.EnableMessageOrdering {
+		conflicts = append(conflicts, fmt.Sprintf("enableMessageOrdering: %v -> %v", cfg.EnableMessageOrdering, spec.EnableMessageOrdering))
+	}
+	if len(conflicts) > 0 {
+		change.Action = SpecConflict
+		change.Diff = append(conflicts, "requires deleting and recreating the subscription")
+		return change, nil
+	}
+
+	toUpdate, changed := settings.configToUpdate(cfg, cli.deadLetterTopicName(spec.DeadLetterTopic))
+	if spec.RetainAckedMessages != nil && *spec.RetainAckedMessages != cfg.RetainAckedMessages {
+		toUpdate.RetainAckedMessages = *spec.RetainAckedMessages
+		changed = true
+	}
+	if spec.EnableExactlyOnceDelivery != cfg.EnableExactlyOnceDelivery {
+		toUpdate.EnableExactlyOnceDelivery = spec.EnableExactlyOnceDelivery
+		changed = true
+	}
+	if !changed {
+		change.Action = SpecUnchanged
+		return change, nil
+	}
+
+	change.Action = SpecUpdate
+	change.Diff = describeSubscriptionUpdate(cfg, toUpdate)
+	change.subUpdate = &toUpdate
+	return change, nil
+}
+
+func (cli *PubSubClient) deadLetterTopicName(topicName string) string {
+	if topicName == "" {
+		return ""
+	}
+	return cli.ServerClient.Topic(topicName).String()
+}
+
+func describeSubscriptionUpdate(cfg pubsub.SubscriptionConfig, toUpdate pubsub.SubscriptionConfigToUpdate) []string {
+	diff := []string{}
+	if toUpdate.AckDeadline != 0 {
+		diff = append(diff, fmt.Sprintf("ackDeadline: %v -> %v", cfg.AckDeadline, toUpdate.AckDeadline))
+	}
+	if toUpdate.RetentionDuration != 0 {
+		diff = append(diff, fmt.Sprintf("retentionDuration: %v -> %v", cfg.RetentionDuration, toUpdate.RetentionDuration))
+	}
+	if toUpdate.RetainAckedMessages != nil {
+		diff = append(diff, fmt.Sprintf("retainAckedMessages: %v -> %v", cfg.RetainAckedMessages, toUpdate.RetainAckedMessages))
+	}
+	if toUpdate.EnableExactlyOnceDelivery != nil {
+		diff = append(diff, fmt.Sprintf("enableExactlyOnceDelivery: %v -> %v", cfg.EnableExactlyOnceDelivery, toUpdate.EnableExactlyOnceDelivery))
+	}
+	if toUpdate.ExpirationPolicy != nil {
+		diff = append(diff, fmt.Sprintf("expirationPolicy: %v -> %v", formatExpiration(cfg.ExpirationPolicy), formatExpiration(toUpdate.ExpirationPolicy)))
+	}
+	if toUpdate.DeadLetterPolicy != nil {
+		current := "none"
+		if cfg.DeadLetterPolicy != nil {
+			current = fmt.Sprintf("%v (%v attempts)", cfg.DeadLetterPolicy.DeadLetterTopic, cfg.DeadLetterPolicy.MaxDeliveryAttempts)
+		}
+		diff = append(diff, fmt.Sprintf("deadLetterPolicy: %v -> %v (%v attempts)", current, toUpdate.DeadLetterPolicy.DeadLetterTopic, toUpdate.DeadLetterPolicy.MaxDeliveryAttempts))
+	}
+	if toUpdate.RetryPolicy != nil {
+		current := "default"
+		if cfg.RetryPolicy != nil {
+			current = fmt.Sprintf("%v..%v", cfg.RetryPolicy.MinimumBackoff, cfg.RetryPolicy.MaximumBackoff)
+		}
+		diff = append(diff, fmt.Sprintf("retryPolicy: %v -> %v..%v", current, toUpdate.RetryPolicy.MinimumBackoff, toUpdate.RetryPolicy.MaximumBackoff))
+	}
+	return diff
+}
+
+// no pubsub a expiracao 0 quer dizer que a subscription nunca expira
+func formatExpiration(policy interface{}) string {
+	d, ok := policy.(time.Duration)
+	if !ok {
+		return "default"
+	}
+	if d == 0 {
+		return "never"
+	}
+	return d.String()
+}
+
+func (cli *PubSubClient) unmanaged(ctx context.Context, managedTopics map[string]bool, managedSubs map[string]bool) ([]SpecChange, error) {
+	ret := []SpecChange{}
+
+	topics := cli.ServerClient.Topics(ctx)
+	for {
+		topic, err := topics.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list topics: %v", err)
+		}
+		if !managedTopics[topic.ID()] {
+			ret = append(ret, SpecChange{Kind: "topic", Name: topic.ID(), Action: SpecUnmanaged})
+		}
+	}
+
+	subs := cli.ServerClient.Subscriptions(ctx)
+	for {
+		sub, err := subs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list subscriptions: %v", err)
+		}
+		if !managedSubs[sub.ID()] {
+			ret = append(ret, SpecChange{Kind: "subscription", Name: sub.ID(), Action: SpecUnmanaged})
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Kind != ret[j].Kind {
+			return ret[i].Kind == "topic"
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// Apply faz o plano e aplica as mudancas: topicos primeiro, depois as subscriptions.
+// Se o plano tiver algum conflito nada e aplicado.
+func (cli *PubSubClient) Apply(ctx context.Context, spec PubSubSpec) ([]SpecChange, error) {
+	changes, err := cli.Plan(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if change.Action == SpecConflict {
+			return changes, fmt.Errorf("%v %v has changes that require recreating it", change.Kind, change.Name)
+		}
+	}
+
+	topics := map[string]TopicSpec{}
+	for _, topicSpec := range spec.Topics {
+		topics[topicSpec.Name] = topicSpec
+	}
+	subs := map[string]SubscriptionSpec{}
+	for _, subSpec := range spec.Subscriptions {
+		subs[subSpec.Name] = subSpec
+	}
+
+	for _, change := range changes {
+		if change.Kind != "topic" {
+			continue
+		}
+		switch change.Action {
+		case SpecCreate:
+			cfg := pubsub.TopicConfig{}
+			if retention := topics[change.Name].MessageRetention; retention != 0 {
+				cfg.RetentionDuration = time.Duration(retention)
+			}
+			if _, err := cli.ServerClient.CreateTopicWithConfig(ctx, change.Name, &cfg); err != nil {
+				return changes, fmt.Errorf("failed to create topic %v: %v", change.Name, err)
+			}
+		case SpecUpdate:
+			if _, err := cli.ServerClient.Topic(change.Name).Update(ctx, *change.topicUpdate); err != nil {
+				return changes, fmt.Errorf("failed to update topic %v: %v", change.Name, err)
+			}
+		default:
+			continue
+		}
+		log.Info("Pub sub spec - ", change.Action, " topic ", change.Name)
+	}
+
+	for _, change := range changes {
+		if change.Kind != "subscription" {
+			continue
+		}
+		subSpec := subs[change.Name]
+		switch change.Action {
+		case SpecCreate:
+			cfg := subSpec.settings().subscriptionConfig(cli.ServerClient.Topic(subSpec.Topic), cli.deadLetterTopicName(subSpec.DeadLetterTopic))
+			if subSpec.RetainAckedMessages != nil {
+				cfg.RetainAckedMessages = *subSpec.RetainAckedMessages
+			}
+			if _, err := cli.ServerClient.CreateSubscription(ctx, change.Name, cfg); err != nil {
+				return changes, fmt.Errorf("failed to create sub %v: %v", change.Name, err)
+			}
+		case SpecUpdate:
+			if _, err := cli.ServerClient.Subscription(change.Name).Update(ctx, *change.subUpdate); err != nil {
+				return changes, fmt.Errorf("failed to update sub %v: %v", change.Name, err)
+			}
+		default:
+			continue
+		}
+		log.Info("Pub sub spec - ", change.Action, " subscription ", change.Name)
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	spoolMinBackoff     = time.Second
+	spoolMaxBackoff     = time.Minute
+	spoolPublishTimeout = 30 * time.Second
+)
+
+// EnableSpool liga o store-and-forward: publishes sincronos (PublishInTopicWithAttribs,
+// PublishInTopicWithOrderingKey, Publish[T]) que falham vao para o spool em disco e
+// retornam nil, e um forwarder em background republica em ordem quando o Pub/Sub voltar.
+// Enquanto o spool tiver mensagens, os publishes novos vao direto para o fim dele para
+// nao passar na frente. maxBytes limita o spool (0 = sem limite); cheio, o publish
+// retorna o erro original. metrics pode ser nil.
+// A entrega e at-least-once: um publish que estourou o timeout pode ter chegado e ser repetido.
+func (cli *PubSubClient) EnableSpool(dir string, maxBytes int64, metrics GaugeRecorder) error {
+	spool, err := OpenSpool(dir, maxBytes)
+	if err != nil {
+		return err
+	}
+	spool.Metrics = metrics
+	spool.mu.Lock()
+	spool.reportMetrics()
+	spool.mu.Unlock()
+
+	cli.Spool = spool
+	cli.spoolStop = make(chan struct{})
+	cli.spoolDone = make(chan struct{})
+	go cli.forwardSpool()
+
+	log.Info("Pub sub spool ok.", dir, spool.Len())
+	return nil
+}
+
+// permanentPublishError sao erros em que tentar de novo nao adianta (ex: mensagem grande demais).
+func permanentPublishError(err error) bool {
+	if errors.Is(err, ErrTopicNotFound) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.PermissionDenied, codes.FailedPrecondition:
+		return true
+	}
+	return false
+}
+
+// publishOrSpool publica esperando a confirmacao, ou grava no spool se ele estiver ligado.
+func (cli *PubSubClient) publishOrSpool(ctx context.Context, topicName string, m *pubsub.Message) (string, error) {
+	if cli.Spool != nil && cli.Spool.Len() > 0 {
+		return "", cli.spool(topicName, m, nil)
+	}
+	if cli.Spool != nil {
+		// sem isso o publish fica preso nas retentativas do client enquanto o Pub/Sub esta fora
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, spoolPublishTimeout)
+		defer cancel()
+	}
+
+	// o publishMessage comprime, assina e faz o claim check no m; o spool guarda a
+	// mensagem original, que e codificada de novo quando for republicada
+	original := &pubsub.Message{
+		Data:        m.Data,
+		Attributes:  copyAttributes(m.Attributes),
+		OrderingKey: m.OrderingKey,
+	}
+
+	result, err := cli.publishMessage(ctx, topicName, m)
+	if err != nil {
+		if cli.Spool == nil || permanentPublishError(err) {
+			return "", err
+		}
+		return "", cli.spool(topicName, original, err)
+	}
+
+	id, err := result.Get(ctx)
+	if err != nil {
+		if cli.Spool == nil || permanentPublishError(err) {
+			return "", fmt.Errorf("get: %v", err)
+		}
+		return "", cli.spool(topicName, original, err)
+	}
+	return id, nil
+}
+
+func (cli *PubSubClient) spool(topicName string, m *pubsub.Message, publishErr error) error {
+	err := cli.Spool.Append(SpoolRecord{
+		Topic:       topicName,
+		Data:        m.Data,
+		Attributes:  m.Attributes,
+		OrderingKey: m.OrderingKey,
+		Time:        time.Now(),
+	})
+	if err != nil {
+		log.Error("Spool - mensagem perdida ", topicName, err, publishErr)
+		if publishErr != nil {
+			return publishErr
+		}
+		return err
+	}
+	if publishErr != nil {
+		log.Warn("Spool - publish falhou, mensagem no spool ", topicName, publishErr)
+	}
+	return nil
+}
+
+func (cli *PubSubClient) forwardSpool() {
+	defer close(cli.spoolDone)
+
+	backoff := spoolMinBackoff
+	for {
+		rec, found, err := cli.Spool.Peek()
+		if err != nil {
+			log.Error("Spool - erro lendo ", err)
+		}
+		if err != nil || !found {
+			select {
+			case <-cli.spoolStop:
+				return
+			case <-cli.Spool.Notify():
+			case <-time.After(spoolMaxBackoff):
+			}
+			continue
+		}
+
+		err = cli.forwardRecord(rec)
+		if err != nil && !permanentPublishError(err) {
+			log.Warn("Spool - Pub/Sub indisponivel, tentando de novo em ", backoff, err)
+			select {
+			case <-cli.spoolStop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > spoolMaxBackoff {
+				backoff = spoolMaxBackoff
+			}
+			continue
+		}
+		if err != nil {
+			log.Error("Spool - descartando mensagem ", rec.Topic, err)
+		}
+
+		backoff = spoolMinBackoff
+		if err := cli.Spool.Commit(); err != nil {
+			log.Error("Spool - erro no commit ", err)
+		}
+
+		select {
+		case <-cli.spoolStop:
+			return
+		default:
+		}
+	}
+}
+
+func (cli *PubSubClient) forwardRecord(rec SpoolRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), spoolPublishTimeout)
+	defer cancel()
+
+	result, err := cli.publishMessage(ctx, rec.Topic, &pubsub.Message{
+		Data:        rec.Data,
+		Attributes:  rec.Attributes,
+		OrderingKey: rec.OrderingKey,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = result.Get(ctx)
+	return err
+}
+
+func (cli *PubSubClient) closeSpool() {
+	if cli.Spool == nil {
+		return
+	}
+	close(cli.spoolStop)
+	<-cli.spoolDone
+	cli.Spool.Close()
+}
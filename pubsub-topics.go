@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MissingTopicPolicy define o que fazer quando um topico usado no publish ou no
+// subscribe nao existe no servidor.
+type MissingTopicPolicy int
+
+const (
+	// MissingTopicCreate cria o topico (default).
+	MissingTopicCreate MissingTopicPolicy = iota
+	// MissingTopicFail retorna ErrTopicNotFound. Para ambientes onde os topicos sao
+	// provisionados fora do servico e a service account nao tem permissao de criar.
+	MissingTopicFail
+)
+
+var ErrTopicNotFound = errors.New("topic not found")
+
+// Topic retorna o topico do cache, buscando (e criando, conforme o MissingTopicPolicy)
+// no servidor no primeiro uso. Chamadas concorrentes para o mesmo topico fazem uma
+// unica consulta ao servidor, que usa o ctx da primeira.
+func (cli *PubSubClient) Topic(ctx context.Context, topicName string) (*pubsub.Topic, error) {
+	return cli.getTopic(ctx, topicName, cli.MissingTopicPolicy == MissingTopicCreate)
+}
+
+// AddTopic cria o topico no servidor se ele nao existir, independente do MissingTopicPolicy,
+// e registra no cache. Consulta o servidor mesmo se o topico ja estiver no cache (ex: o
+// topico default, que e registrado sem consulta).
+func (cli *PubSubClient) AddTopic(topicName string) error {
+	if topicName == "" {
+		return fmt.Errorf("%w: empty topic name", ErrTopicNotFound)
+	}
+	_, err, _ := cli.topicGroup.Do(topicName+"|add", func() (interface{}, error) {
+		return cli.loadTopic(context.Background(), topicName, true)
+	})
+	return err
+}
+
+// RemoveTopic para o envio do topico e tira ele do cache. Nao apaga o topico no servidor.
+func (cli *PubSubClient) RemoveTopic(topicName string) {
+	cli.topicsMu.Lock()
+	topic, found := cli.Topics[topicName]
+	delete(cli.Topics, topicName)
+	cli.topicsMu.Unlock()
+
+	if found {
+		topic.Stop()
+	}
+}
+
+func (cli *PubSubClient) getTopic(ctx context.Context, topicName string, create bool) (*pubsub.Topic, error) {
+	if topicName == "" {
+		return nil, fmt.Errorf("%w: empty topic name", ErrTopicNotFound)
+	}
+
+	cli.topicsMu.RLock()
+	topic, found := cli.Topics[topicName]
+	cli.topicsMu.RUnlock()
+	if found {
+		return topic, nil
+	}
+
+	key := fmt.Sprintf("%v|%v", topicName, create)
+	loaded := cli.topicGroup.DoChan(key, func() (interface{}, error) {
+		return cli.loadTopic(ctx, topicName, create)
+	})
+	select {
+	case res := <-loaded:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*pubsub.Topic), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to load topic %v: %w", topicName, ctx.Err())
+	}
+}
+
+func (cli *PubSubClient) loadTopic(ctx context.Context, topicName string, create bool) (*pubsub.Topic, error) {
+	topic := cli.ServerClient.Topic(topicName)
+	topicExists, err := topic.Exists(ctx)
+	if status.Code(err) == codes.PermissionDenied {
+		// service account so com roles/pubsub.publisher nao tem pubsub.topics.get; se o
+		// topico nao existir o erro aparece no publish
+		log.Debug("Topic - sem permissao para consultar, assumindo que existe ", topicName)
+		topicExists, err = true, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if topic %v exists: %w", topicName, err)
+	}
+	if !topicExists {
+		if !create {
+			return nil, fmt.Errorf("%w: %v", ErrTopicNotFound, topicName)
+		}
+		topic, err = cli.ServerClient.CreateTopic(ctx, topicName)
+		if status.Code(err) == codes.AlreadyExists {
+			// criado por outra replica entre o Exists e o CreateTopic
+			topic, err = cli.ServerClient.Topic(topicName), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create topic %v: %w", topicName, err)
+		}
+		log.Info("Topic created", topicName)
+	}
+
+	cli.topicsMu.Lock()
+	defer cli.topicsMu.Unlock()
+
+	// outra chamada (com o outro valor de create) pode ter registrado antes
+	if current, found := cli.Topics[topicName]; found {
+		return current, nil
+	}
+	cli.registerTopic(topicName, topic)
+	return topic, nil
+}
+
+// registerTopic configura o topico e coloca no cache. Precisa do topicsMu.
+// O ordering fica sempre ligado: o topico e compartilhado e o pubsub le o campo sem lock
+// no Publish, entao ele nao pode mudar depois. Mensagens sem ordering key continuam
+// sendo enviadas em paralelo.
+func (cli *PubSubClient) registerTopic(topicName string, topic *pubsub.Topic) {
+	if cli.PublishSettings != nil {
+		topic.PublishSettings = *cli.PublishSettings
+	}
+	topic.EnableMessageOrdering = true
+	cli.Topics[topicName] = topic
+}
+
+// cachedTopics retorna uma copia dos topicos registrados, para iterar sem segurar o lock.
+func (cli *PubSubClient) cachedTopics() []*pubsub.Topic {
+	cli.topicsMu.RLock()
+	defer cli.topicsMu.RUnlock()
+
+	ret := make([]*pubsub.Topic, 0, len(cli.Topics))
+	for _, topic := range cli.Topics {
+		ret = append(ret, topic)
+	}
+	return ret
+}
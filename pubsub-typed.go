@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ContentTypeAttribute = "content-type"
+	ContentTypeJSON      = "application/json"
+
+	// atributo com o erro nas mensagens enviadas para o topico de erro
+	errorAttribute = "error"
+)
+
+// TypedHandler recebe a mensagem ja decodificada.
+type TypedHandler[T any] func(ctx context.Context, msg Message, value T) error
+
+// ErrorHandler recebe as mensagens que nao puderam ser processadas (ex: JSON invalido).
+// Retornar nil faz o ack da mensagem, retornar erro faz o nack.
+type ErrorHandler func(ctx context.Context, msg Message, err error) error
+
+// Publish serializa value em JSON e publica no topico com os atributos type e content-type.
+func Publish[T any](ctx context.Context, cli *PubSubClient, topic string, msgType string, value T) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %v: %v", msgType, err)
+	}
+
+	id, err := cli.publishOrSpool(ctx, topic, &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"type":               msgType,
+			ContentTypeAttribute: ContentTypeJSON,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Debug("Published a message; msg ID:", id)
+	return nil
+}
+
+// JSONHandler adapta um TypedHandler para MessageHandler. Mensagens que nao decodificam
+// vao para onError; se onError for nil, o erro e logado e a mensagem descartada (ack).
+func JSONHandler[T any](handler TypedHandler[T], onError ErrorHandler) MessageHandler {
+	return func(ctx context.Context, msg Message) error {
+		var value T
+		err := decodeJSONMessage(msg, &value)
+		if err != nil {
+			if onError == nil {
+				log.Error("Decode - descartando mensagem ", msg.ID, err)
+				return nil
+			}
+			return onError(ctx, msg, err)
+		}
+		return handler(ctx, msg, value)
+	}
+}
+
+func decodeJSONMessage(msg Message, value interface{}) error {
+	contentType := msg.Attributes[ContentTypeAttribute]
+	if contentType != "" && contentType != ContentTypeJSON {
+		return fmt.Errorf("unsupported content type %q", contentType)
+	}
+	if err := json.Unmarshal(msg.Data, value); err != nil {
+		return fmt.Errorf("failed to decode %v: %v", msg.Attributes["type"], err)
+	}
+	return nil
+}
+
+// ConsumeJSON e o Consume com as mensagens decodificadas para T.
+func ConsumeJSON[T any](ctx context.Context, cli *PubSubClient, topicName string, subscriberName string, handler TypedHandler[T], onError ErrorHandler) error {
+	return cli.Consume(ctx, topicName, subscriberName, JSONHandler(handler, onError))
+}
+
+// ErrorTopicHandler e um ErrorHandler que republica a mensagem original no topico
+// de erro, com o motivo no atributo "error".
+func ErrorTopicHandler(cli *PubSubClient, topicName string) ErrorHandler {
+	return func(ctx context.Context, msg Message, err error) error {
+		attributes := map[string]string{}
+		for key, val := range msg.Attributes {
+			attributes[key] = val
+		}
+		attributes[errorAttribute] = err.Error()
+
+		result, pubErr := cli.publishMessage(ctx, topicName, &pubsub.Message{
+			Data:       msg.Data,
+			Attributes: attributes,
+		})
+		if pubErr != nil {
+			return pubErr
+		}
+		if _, pubErr = result.Get(ctx); pubErr != nil {
+			return fmt.Errorf("failed to publish to error topic: %v", pubErr)
+		}
+		return nil
+	}
+}
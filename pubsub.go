@@ -3,9 +3,13 @@ package lib
 import (
 	"context"
 	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/api/option"
 )
 
@@ -13,7 +17,28 @@ type PubSubClient struct {
 	ServerClient     *pubsub.Client
 	ProjectID        string
 	DefaultTopicName string
-	Topics           map[string]*pubsub.Topic
+	// Cache dos topicos ja usados. Acessar pelo Topic/AddTopic/RemoveTopic.
+	Topics map[string]*pubsub.Topic
+	// O que fazer com topicos que nao existem no servidor (default: criar).
+	MissingTopicPolicy MissingTopicPolicy
+	// Batching e flow control dos topicos, ver SetPublishSettings. nil usa pubsub.DefaultPublishSettings.
+	PublishSettings *pubsub.PublishSettings
+	// Payloads grandes no storage, ver EnableClaimCheck. nil desliga.
+	ClaimCheck *ClaimCheck
+	// Compressao e assinatura do payload, ver EnablePayloadCodec. nil desliga.
+	Payload *PayloadCodec
+	// Recebe as mensagens cujo ack/nack falhou (so acontece com exactly-once). nil so loga.
+	OnAckError ErrorHandler
+	// Opcional, recebe o contador "pubsub_ack_errors".
+	Metrics MetricsRecorder
+	// Store-and-forward dos publishes que falham, ver EnableSpool. nil desliga.
+	Spool *Spool
+
+	inFlight   inFlightTracker
+	topicsMu   sync.RWMutex
+	topicGroup singleflight.Group
+	spoolStop  chan struct{}
+	spoolDone  chan struct{}
 }
 
 func GetPubSubClient(projectID string, topicOut string) *PubSubClient {
@@ -24,118 +49,346 @@ func GetPubSubClientWithJSONCredentials(projectID string, topicOut string, jsonC
 	return initAndConnect(projectID, topicOut, jsonCredentials)
 }
 
-func initAndConnect(projectID string, topicOut string, jsonCredentials []byte) *PubSubClient {
+// NewPubSubClient e como o GetPubSubClient, mas retorna erro em vez de panic e aceita
+// as options do client (endpoint, credenciais, etc). Com PUBSUB_EMULATOR_HOST definido
+// conecta no emulador.
+func NewPubSubClient(ctx context.Context, projectID string, topicOut string, opts ...option.ClientOption) (*PubSubClient, error) {
+	client := newPubSubClient(projectID, topicOut)
+	if err := client.connect(ctx, opts...); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func newPubSubClient(projectID string, topicOut string) *PubSubClient {
 	client := PubSubClient{}
 
 	client.Topics = map[string]*pubsub.Topic{}
 	client.ProjectID = projectID
 	client.DefaultTopicName = topicOut
 
-	client.connect(jsonCredentials)
-
 	return &client
 }
 
-func (cli *PubSubClient) connect(jsonCredentials []byte) {
-	log.Debug("Connecting to pub sub...", cli.ProjectID, cli.DefaultTopicName)
+func initAndConnect(projectID string, topicOut string, jsonCredentials []byte) *PubSubClient {
+	client := newPubSubClient(projectID, topicOut)
 
-	ctx := context.Background()
-	var err error
-	if len(jsonCredentials) > 0 {
-		cli.ServerClient, err = pubsub.NewClient(ctx, cli.ProjectID, option.WithCredentialsJSON(jsonCredentials))
-	} else {
-		cli.ServerClient, err = pubsub.NewClient(ctx, cli.ProjectID)
+	opts := []option.ClientOption{}
+	if len(jsonCredentials) > 0 && os.Getenv(emulatorHostEnv) == "" {
+		opts = append(opts, option.WithCredentialsJSON(jsonCredentials))
 	}
-	if err != nil {
-		log.Error("pubsub.NewClient: ", cli.ProjectID, cli.DefaultTopicName, err)
+
+	if err := client.connect(context.Background(), opts...); err != nil {
 		panic(err)
 	}
 
-	cli.Topics[cli.DefaultTopicName] = cli.ServerClient.Topic(cli.DefaultTopicName)
+	return client
+}
 
-	log.Info("Pub sub ok.", cli.ProjectID, cli.DefaultTopicName)
+// variavel de ambiente do emulador, lida pelo pubsub.NewClient
+const emulatorHostEnv = "PUBSUB_EMULATOR_HOST"
 
-}
+func (cli *PubSubClient) connect(ctx context.Context, opts ...option.ClientOption) error {
+	log.Debug("Connecting to pub sub...", cli.ProjectID, cli.DefaultTopicName)
+	if emulator := os.Getenv(emulatorHostEnv); emulator != "" {
+		log.Info("Using pub sub emulator ", emulator)
+	}
 
-func (cli *PubSubClient) AddTopic(topicName string) error {
-	topic := cli.ServerClient.Topic(topicName)
-	topicExists, err := topic.Exists(context.Background())
+	var err error
+	cli.ServerClient, err = pubsub.NewClient(ctx, cli.ProjectID, opts...)
 	if err != nil {
-		return fmt.Errorf("failed to check if topic exists: %v", err)
+		log.Error("pubsub.NewClient: ", cli.ProjectID, cli.DefaultTopicName, err)
+		return fmt.Errorf("pubsub.NewClient: %v", err)
 	}
-	if !topicExists {
-		topic, err = cli.ServerClient.CreateTopic(context.Background(), topicName)
-		if err != nil {
-			return fmt.Errorf("failed to create topic: %v", err)
-		}
+
+	// o topico default e usado sem consultar o servidor, como sempre foi: a service
+	// account pode ter so roles/pubsub.publisher
+	if cli.DefaultTopicName != "" {
+		cli.topicsMu.Lock()
+		cli.registerTopic(cli.DefaultTopicName, cli.ServerClient.Topic(cli.DefaultTopicName))
+		cli.topicsMu.Unlock()
 	}
-	cli.Topics[topicName] = topic
+
+	log.Info("Pub sub ok.", cli.ProjectID, cli.DefaultTopicName)
 	return nil
 }
 
-func (cli *PubSubClient) RemoveTopic(topicName string) {
-	cli.Topics[topicName].Stop()
-	delete(cli.Topics, topicName)
+// SubscribeSettings configura a subscription e o recebimento das mensagens.
+// Campos zerados usam o default do pubsub.
+type SubscribeSettings struct {
+	Synchronous            bool
+	MaxOutstandingMessages int
+	MaxOutstandingBytes    int
+	NumGoroutines          int
+	MaxExtension           time.Duration
+	AckDeadline            time.Duration
+
+	// Topico para onde vao as mensagens que falharam MaxDeliveryAttempts vezes (default 5).
+	// E criado se nao existir. A service account do Pub/Sub precisa de permissao de
+	// publisher nele e de subscriber na subscription.
+	DeadLetterTopic     string
+	MaxDeliveryAttempts int
+	MinRetryBackoff     time.Duration
+	MaxRetryBackoff     time.Duration
+	RetentionDuration   time.Duration
+	// 0 usa o default do servidor (31 dias), NeverExpire faz a subscription nunca expirar.
+	ExpirationPolicy time.Duration
+	// So valem na criacao da subscription, nao podem ser alterados depois.
+	EnableMessageOrdering bool
+	Filter                string
+	// Pode ser ligado numa subscription existente. Com ele o ack pode falhar, ver OnAckError.
+	EnableExactlyOnceDelivery bool
 }
 
+const NeverExpire time.Duration = -1
+
+const defaultMaxDeliveryAttempts = 5
+
 func (cli *PubSubClient) Subscribe(topicName string, subscriberName string, sync bool) (*pubsub.Subscription, error) {
+	return cli.SubscribeWithSettings(topicName, subscriberName, SubscribeSettings{
+		Synchronous:            sync, // sincrono pra evitar concorrencia
+		MaxOutstandingMessages: 1,
+	})
+}
+
+// SubscribeWithSettings cria a subscription se ela nao existir, ou atualiza a
+// configuracao dela no servidor para ficar igual a settings.
+func (cli *PubSubClient) SubscribeWithSettings(topicName string, subscriberName string, settings SubscribeSettings) (*pubsub.Subscription, error) {
 	ctx := context.Background()
-	if _, found := cli.Topics[topicName]; !found {
-		err := cli.AddTopic(topicName)
+	topic, err := cli.Topic(ctx, topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetterTopic := ""
+	if settings.DeadLetterTopic != "" {
+		dlt, err := cli.Topic(ctx, settings.DeadLetterTopic)
 		if err != nil {
-			return nil, fmt.Errorf("failed to add topic: %v", err)
+			return nil, fmt.Errorf("dead letter topic: %w", err)
 		}
+		deadLetterTopic = dlt.String()
 	}
 
-	topic := cli.Topics[topicName]
-
 	sub := cli.ServerClient.Subscription(subscriberName)
 	subExists, err := sub.Exists(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check if sub exists: %v", err)
 	}
 	if !subExists {
-		sub, err = cli.ServerClient.CreateSubscription(ctx, subscriberName,
-			pubsub.SubscriptionConfig{Topic: topic})
+		sub, err = cli.ServerClient.CreateSubscription(ctx, subscriberName, settings.subscriptionConfig(topic, deadLetterTopic))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sub: %v", err)
+		}
+	} else {
+		cfg, err := sub.Config(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get sub config: %v", err)
+		}
+		if settings.EnableMessageOrdering && !cfg.EnableMessageOrdering {
+			log.Warn("Subscription already exists without message ordering", subscriberName)
+		}
+		if settings.Filter != cfg.Filter {
+			log.Warn("Subscription already exists with another filter", subscriberName, cfg.Filter)
+		}
+		if toUpdate, changed := settings.configToUpdate(cfg, deadLetterTopic); changed {
+			log.Info("Updating subscription config", subscriberName)
+			if _, err := sub.Update(ctx, toUpdate); err != nil {
+				return nil, fmt.Errorf("failed to update sub: %v", err)
+			}
+		}
 	}
 
-	sub.ReceiveSettings.Synchronous = sync // sincrono pra evitar concorrencia
-	sub.ReceiveSettings.MaxOutstandingMessages = 1
+	sub.ReceiveSettings.Synchronous = settings.Synchronous
+	if settings.MaxOutstandingMessages != 0 {
+		sub.ReceiveSettings.MaxOutstandingMessages = settings.MaxOutstandingMessages
+	}
+	if settings.MaxOutstandingBytes != 0 {
+		sub.ReceiveSettings.MaxOutstandingBytes = settings.MaxOutstandingBytes
+	}
+	if settings.NumGoroutines != 0 {
+		sub.ReceiveSettings.NumGoroutines = settings.NumGoroutines
+	}
+	if settings.MaxExtension != 0 {
+		sub.ReceiveSettings.MaxExtension = settings.MaxExtension
+	}
 
 	return sub, nil
 
 }
 
+func (settings SubscribeSettings) subscriptionConfig(topic *pubsub.Topic, deadLetterTopic string) pubsub.SubscriptionConfig {
+	cfg := pubsub.SubscriptionConfig{
+		Topic:             topic,
+		AckDeadline:       settings.AckDeadline,
+		RetentionDuration: settings.RetentionDuration,
+		DeadLetterPolicy:  settings.deadLetterPolicy(deadLetterTopic),
+		RetryPolicy:       settings.retryPolicy(),
+
+		EnableMessageOrdering:     settings.EnableMessageOrdering,
+		Filter:                    settings.Filter,
+		EnableExactlyOnceDelivery: settings.EnableExactlyOnceDelivery,
+	}
+	if settings.ExpirationPolicy != 0 {
+		cfg.ExpirationPolicy = settings.expirationPolicy()
+	}
+	return cfg
+}
+
+// configToUpdate retorna o que precisa mudar na subscription existente.
+// Campos zerados em settings nao alteram o que esta no servidor.
+func (settings SubscribeSettings) configToUpdate(cfg pubsub.SubscriptionConfig, deadLetterTopic string) (pubsub.SubscriptionConfigToUpdate, bool) {
+	toUpdate := pubsub.SubscriptionConfigToUpdate{}
+	changed := false
+
+	if settings.AckDeadline != 0 && settings.AckDeadline != cfg.AckDeadline {
+		toUpdate.AckDeadline = settings.AckDeadline
+		changed = true
+	}
+
+	if settings.RetentionDuration != 0 && settings.RetentionDuration != cfg.RetentionDuration {
+		toUpdate.RetentionDuration = settings.RetentionDuration
+		changed = true
+	}
+
+	if settings.EnableExactlyOnceDelivery && !cfg.EnableExactlyOnceDelivery {
+		toUpdate.EnableExactlyOnceDelivery = true
+		changed = true
+	}
+
+	if settings.ExpirationPolicy != 0 {
+		current, ok := cfg.ExpirationPolicy.(time.Duration)
+		if !ok || current != settings.expirationPolicy() {
+			toUpdate.ExpirationPolicy = settings.expirationPolicy()
+			changed = true
+		}
+	}
+
+	if dlp := settings.deadLetterPolicy(deadLetterTopic); dlp != nil {
+		if cfg.DeadLetterPolicy == nil || *cfg.DeadLetterPolicy != *dlp {
+			toUpdate.DeadLetterPolicy = dlp
+			changed = true
+		}
+	}
+
+	if rp := settings.retryPolicy(); rp != nil {
+		current := pubsub.RetryPolicy{}
+		if cfg.RetryPolicy != nil {
+			current = *cfg.RetryPolicy
+		}
+		currentMin, _ := current.MinimumBackoff.(time.Duration)
+		currentMax, _ := current.MaximumBackoff.(time.Duration)
+		if currentMin != rp.MinimumBackoff.(time.Duration) || currentMax != rp.MaximumBackoff.(time.Duration) {
+			toUpdate.RetryPolicy = rp
+			changed = true
+		}
+	}
+
+	return toUpdate, changed
+}
+
+func (settings SubscribeSettings) deadLetterPolicy(deadLetterTopic string) *pubsub.DeadLetterPolicy {
+	if deadLetterTopic == "" {
+		return nil
+	}
+	maxAttempts := settings.MaxDeliveryAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultMaxDeliveryAttempts
+	}
+	return &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     deadLetterTopic,
+		MaxDeliveryAttempts: maxAttempts,
+	}
+}
+
+func (settings SubscribeSettings) retryPolicy() *pubsub.RetryPolicy {
+	if settings.MinRetryBackoff == 0 && settings.MaxRetryBackoff == 0 {
+		return nil
+	}
+	// mesmos defaults do servidor
+	minBackoff, maxBackoff := 10*time.Second, 600*time.Second
+	if settings.MinRetryBackoff != 0 {
+		minBackoff = settings.MinRetryBackoff
+	}
+	if settings.MaxRetryBackoff != 0 {
+		maxBackoff = settings.MaxRetryBackoff
+	}
+	return &pubsub.RetryPolicy{
+		MinimumBackoff: minBackoff,
+		MaximumBackoff: maxBackoff,
+	}
+}
+
+func (settings SubscribeSettings) expirationPolicy() time.Duration {
+	if settings.ExpirationPolicy == NeverExpire {
+		return 0
+	}
+	return settings.ExpirationPolicy
+}
+
 func (cli *PubSubClient) Publish(msgType string, msg string) error {
+	return cli.PublishCtx(context.Background(), msgType, msg)
+}
+
+// PublishCtx e o Publish com ctx; o traceparent do ctx vai nos atributos.
+func (cli *PubSubClient) PublishCtx(ctx context.Context, msgType string, msg string) error {
 	attributes := map[string]string{}
-	return cli.PublishWithAttribs(msgType, msg, attributes)
+	return cli.PublishWithAttribsCtx(ctx, msgType, msg, attributes)
 }
 
 func (cli *PubSubClient) PublishWithAttribs(msgType string, msg string, attributes map[string]string) error {
+	return cli.PublishWithAttribsCtx(context.Background(), msgType, msg, attributes)
+}
+
+// PublishWithAttribsCtx e o PublishWithAttribs com ctx.
+func (cli *PubSubClient) PublishWithAttribsCtx(ctx context.Context, msgType string, msg string, attributes map[string]string) error {
 	attributes["type"] = msgType
-	return cli.PublishInTopicWithAttribs(cli.DefaultTopicName, msg, attributes)
+	return cli.PublishInTopicWithAttribsCtx(ctx, cli.DefaultTopicName, msg, attributes)
 }
 
 func (cli *PubSubClient) PublishInTopicWithAttribs(topic string, msg string, attributes map[string]string) error {
-	ctx := context.Background()
-	if _, found := cli.Topics[topic]; !found {
-		cli.AddTopic(topic)
-	}
-	result := cli.Topics[topic].Publish(ctx, &pubsub.Message{
-		Data:       []byte(msg),
-		Attributes: attributes,
-	})
+	return cli.PublishInTopicWithAttribsCtx(context.Background(), topic, msg, attributes)
+}
 
+// PublishInTopicWithAttribsCtx e o PublishInTopicWithAttribs com ctx.
+func (cli *PubSubClient) PublishInTopicWithAttribsCtx(ctx context.Context, topic string, msg string, attributes map[string]string) error {
 	// Block until the result is returned and a server-generated
 	// ID is returned for the published message.
-	id, err := result.Get(ctx)
+	id, err := cli.publishOrSpool(ctx, topic, &pubsub.Message{
+		Data:       []byte(msg),
+		Attributes: attributes,
+	})
 	if err != nil {
-		return fmt.Errorf("get: %v", err)
+		return err
 	}
 	log.Debug("Published a message; msg ID:", id)
 	return nil
 }
 
+// PublishInTopicWithOrderingKey publica garantindo a entrega na ordem de publicacao para
+// mensagens com a mesma orderingKey (ex: o ID do device). A subscription precisa ter
+// EnableMessageOrdering.
+func (cli *PubSubClient) PublishInTopicWithOrderingKey(topic string, msg string, attributes map[string]string, orderingKey string) error {
+	return cli.PublishInTopicWithOrderingKeyCtx(context.Background(), topic, msg, attributes, orderingKey)
+}
+
+// PublishInTopicWithOrderingKeyCtx e o PublishInTopicWithOrderingKey com ctx.
+func (cli *PubSubClient) PublishInTopicWithOrderingKeyCtx(ctx context.Context, topic string, msg string, attributes map[string]string, orderingKey string) error {
+	id, err := cli.publishOrSpool(ctx, topic, &pubsub.Message{
+		Data:        []byte(msg),
+		Attributes:  attributes,
+		OrderingKey: orderingKey,
+	})
+	if err != nil {
+		return err
+	}
+	log.Debug("Published a message; msg ID:", id, orderingKey)
+	return nil
+}
+
 func (cli *PubSubClient) Close() {
+	cli.closeSpool()
+	for _, topic := range cli.cachedTopics() {
+		topic.Stop()
+	}
 	cli.ServerClient.Close()
 }
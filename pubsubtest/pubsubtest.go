@@ -0,0 +1,126 @@
+// Package pubsubtest roda um Pub/Sub em memoria (pstest) para testes de integracao
+// sem acesso ao GCP.
+package pubsubtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub/pstest"
+	lib "github.com/dev-konfido/go-utils"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type Server struct {
+	*pstest.Server
+	Client *lib.PubSubClient
+}
+
+// NewServer sobe o servidor em memoria e retorna um PubSubClient conectado nele,
+// com o topico default ja criado. Os demais topicos e subscriptions sao criados no
+// primeiro uso (AddTopic/Subscribe/Publish).
+func NewServer(projectID string, defaultTopic string) (*Server, error) {
+	srv := pstest.NewServer()
+
+	ctx := context.Background()
+	cli, err := lib.NewPubSubClient(ctx, projectID, defaultTopic,
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+
+	if err := cli.AddTopic(defaultTopic); err != nil {
+		cli.Close()
+		srv.Close()
+		return nil, err
+	}
+
+	return &Server{Server: srv, Client: cli}, nil
+}
+
+func (s *Server) Close() error {
+	s.Client.Close()
+	return s.Server.Close()
+}
+
+// Publish publica direto no servidor, sem passar pelo PubSubClient.
+func (s *Server) Publish(topic string, data []byte, attributes map[string]string) string {
+	return s.Server.Publish(s.topicName(topic), data, attributes)
+}
+
+// PublishedMessages retorna todas as mensagens publicadas no servidor, de todos os topicos.
+func (s *Server) PublishedMessages() []lib.Message {
+	ret := []lib.Message{}
+	for _, m := range s.Server.Messages() {
+		ret = append(ret, lib.Message{
+			ID:          m.ID,
+			Data:        m.Data,
+			Attributes:  m.Attributes,
+			PublishTime: m.PublishTime,
+			OrderingKey: m.OrderingKey,
+		})
+	}
+	return ret
+}
+
+// WaitForPublished espera ate o servidor ter pelo menos n mensagens publicadas.
+func (s *Server) WaitForPublished(ctx context.Context, n int) ([]lib.Message, error) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		msgs := s.PublishedMessages()
+		if len(msgs) >= n {
+			return msgs, nil
+		}
+		select {
+		case <-ctx.Done():
+			return msgs, fmt.Errorf("got %d of %d messages: %v", len(msgs), n, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Receive consome n mensagens da subscription (criada se nao existir) e retorna elas.
+// A subscription precisa existir antes do publish para receber as mensagens.
+func (s *Server) Receive(ctx context.Context, topic string, subscription string, n int) ([]lib.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	ret := []lib.Message{}
+	err := s.Client.ConsumeWithSettings(ctx, topic, subscription, lib.SubscribeSettings{}, func(_ context.Context, msg lib.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(ret) >= n {
+			// devolve as que chegaram depois das n
+			return fmt.Errorf("already received %d messages", n)
+		}
+		ret = append(ret, msg)
+		if len(ret) >= n {
+			cancel()
+		}
+		return nil
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		return ret, err
+	}
+	if len(ret) < n {
+		return ret, fmt.Errorf("got %d of %d messages", len(ret), n)
+	}
+	return ret, nil
+}
+
+func (s *Server) topicName(topic string) string {
+	return fmt.Sprintf("projects/%v/topics/%v", s.Client.ProjectID, topic)
+}
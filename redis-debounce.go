@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Um evento so e confirmado depois de N amostras consecutivas. Parametros lidos via GetGtwConfigInt:
+
+	"cfg_gateway_config_<inst>_event_samples_<event>"        amostras para levantar o evento
+	"cfg_gateway_config_<inst>_event_samples_<event>_clear"  amostras para baixar o evento (default = samples)
+	"cfg_gateway_config_<inst>_event_param_<event>_set"      valor a partir do qual a amostra conta como ativa
+	"cfg_gateway_config_<inst>_event_param_<event>_clear"    valor abaixo do qual a amostra conta como inativa (default = set)
+*/
+
+type DebounceTransition struct {
+	Instance string
+	DeviceID string
+	Event    string
+	Raised   bool
+	Samples  int64
+	Time     time.Time
+}
+
+type DebounceCallback func(ctx context.Context, transition DebounceTransition)
+
+type EventDebouncer struct {
+	Redis    *RedisClient
+	Callback DebounceCallback
+	// TTL do estado de cada device, renovado a cada amostra
+	StateTTL time.Duration
+}
+
+// KEYS[1] = estado do device; ARGV = ativo (1/0/-1 = sem mudanca), amostras para subir, amostras para descer, ttl ms
+// Retorna {transicao (1 = raise, -1 = clear, 0 = nada), contador}
+var debounceScript = redis.NewScript(`
+local state = tonumber(redis.call("HGET", KEYS[1], "state") or "0")
+local count = tonumber(redis.call("HGET", KEYS[1], "count") or "0")
+local active = tonumber(ARGV[1])
+local ret = 0
+
+if active < 0 or active == state then
+	count = 0
+else
+	count = count + 1
+	local needed = tonumber(ARGV[2])
+	if state == 1 then
+		needed = tonumber(ARGV[3])
+	end
+	if count >= needed then
+		state = active
+		count = 0
+		if active == 1 then ret = 1 else ret = -1 end
+	end
+end
+
+redis.call("HSET", KEYS[1], "state", state, "count", count)
+if tonumber(ARGV[4]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+return {ret, count}
+`)
+
+func (c *RedisClient) GetEventDebouncer(callback DebounceCallback, stateTTL time.Duration) *EventDebouncer {
+	return &EventDebouncer{
+		Redis:    c,
+		Callback: callback,
+		StateTTL: stateTTL,
+	}
+}
+
+func (d *EventDebouncer) key(instance string, deviceID string, event string) string {
+	return fmt.Sprintf("dbc_%v_%v_%v", instance, event, deviceID)
+}
+
+func (d *EventDebouncer) samples(instance string, event string) (int64, int64) {
+	raise := d.Redis.GetGtwConfigInt(instance, "event_samples_"+event)
+	if raise < 1 {
+		raise = 1
+	}
+	clear := d.Redis.GetGtwConfigInt(instance, "event_samples_"+event+"_clear")
+	if clear < 1 {
+		clear = raise
+	}
+	return raise, clear
+}
+
+// Sample registra uma amostra booleana do evento e retorna true se houve transicao confirmada.
+func (d *EventDebouncer) Sample(ctx context.Context, instance string, deviceID string, event string, active bool) (bool, error) {
+	val := int64(0)
+	if active {
+		val = 1
+	}
+	return d.sample(ctx, instance, deviceID, event, val)
+}
+
+// SampleValue registra uma amostra numerica usando os limites set/clear (histerese):
+// valor >= set conta como ativo, valor < clear conta como inativo, entre os dois mantem o estado.
+func (d *EventDebouncer) SampleValue(ctx context.Context, instance string, deviceID string, event string, value int64) (bool, error) {
+	set := d.Redis.GetGtwConfigInt(instance, "event_param_"+event+"_set")
+	clear := d.Redis.GetGtwConfigString(instance, "event_param_"+event+"_clear")
+
+	clearVal := set
+	if clear != "" {
+		clearVal = StrToInt(clear)
+	}
+
+	val := int64(-1)
+	if value >= set {
+		val = 1
+	} else if value < clearVal {
+		val = 0
+	}
+	return d.sample(ctx, instance, deviceID, event, val)
+}
+
+func (d *EventDebouncer) sample(ctx context.Context, instance string, deviceID string, event string, active int64) (bool, error) {
+	raise, clear := d.samples(instance, event)
+
+	res, err := debounceScript.Run(ctx, d.Redis.ServerClient,
+		[]string{d.key(instance, deviceID, event)},
+		active, raise, clear, d.StateTTL.Milliseconds()).Int64Slice()
+	if err != nil {
+		return false, fmt.Errorf("debounce script: %v", err)
+	}
+	if len(res) < 2 || res[0] == 0 {
+		return false, nil
+	}
+
+	transition := DebounceTransition{
+		Instance: instance,
+		DeviceID: deviceID,
+		Event:    event,
+		Raised:   res[0] > 0,
+		Samples:  raise,
+		Time:     time.Now(),
+	}
+	if !transition.Raised {
+		transition.Samples = clear
+	}
+
+	log.Debug("Debounce transition", instance, deviceID, event, transition.Raised)
+	if d.Callback != nil {
+		d.Callback(ctx, transition)
+	}
+	return true, nil
+}
+
+// State retorna se o evento esta ativo para o device.
+func (d *EventDebouncer) State(ctx context.Context, instance string, deviceID string, event string) (bool, error) {
+	state, err := d.Redis.ServerClient.HGet(ctx, d.key(instance, deviceID, event), "state").Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return state == "1", nil
+}
+
+func (d *EventDebouncer) Reset(ctx context.Context, instance string, deviceID string, event string) error {
+	return d.Redis.ServerClient.Del(ctx, d.key(instance, deviceID, event)).Err()
+}
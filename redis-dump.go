@@ -0,0 +1,291 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+type KeyPatternStats struct {
+	Pattern     string           `json:"pattern"`
+	Keys        int64            `json:"keys"`
+	MemoryBytes int64            `json:"memoryBytes"`
+	Types       map[string]int64 `json:"types"`
+	TTLBuckets  map[string]int64 `json:"ttlBuckets"`
+}
+
+// faixas de TTL usadas no InspectKeys, em ordem
+var ttlBuckets = []struct {
+	name  string
+	limit time.Duration
+}{
+	{"<1m", time.Minute},
+	{"<1h", time.Hour},
+	{"<1d", 24 * time.Hour},
+	{"<7d", 7 * 24 * time.Hour},
+}
+
+func ttlBucket(ttl time.Duration) string {
+	if ttl < 0 {
+		return "none"
+	}
+	for _, bucket := range ttlBuckets {
+		if ttl < bucket.limit {
+			return bucket.name
+		}
+	}
+	return ">=7d"
+}
+
+// InspectKeys conta as chaves do pattern com uso de memoria, tipos e distribuicao de TTL.
+func (c *RedisClient) InspectKeys(ctx context.Context, pattern string) (KeyPatternStats, error) {
+	stats := KeyPatternStats{
+		Pattern:    pattern,
+		Types:      map[string]int64{},
+		TTLBuckets: map[string]int64{},
+	}
+
+	keys := c.Scan(pattern)
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		pipe := c.ServerClient.Pipeline()
+		mems := make([]*redis.IntCmd, 0, end-start)
+		ttls := make([]*redis.DurationCmd, 0, end-start)
+		types := make([]*redis.StatusCmd, 0, end-start)
+		for _, key := range keys[start:end] {
+			mems = append(mems, pipe.MemoryUsage(ctx, key))
+			ttls = append(ttls, pipe.PTTL(ctx, key))
+			types = append(types, pipe.Type(ctx, key))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return stats, fmt.Errorf("inspect %v: %v", pattern, err)
+		}
+
+		for i := range mems {
+			keyType := types[i].Val()
+			if keyType == "none" {
+				// expirou entre o scan e o pipeline
+				continue
+			}
+			stats.Keys++
+			stats.MemoryBytes += mems[i].Val()
+			stats.Types[keyType]++
+			stats.TTLBuckets[ttlBucket(ttls[i].Val())]++
+		}
+	}
+
+	return stats, nil
+}
+
+type KeyDump struct {
+	Key    string             `json:"key"`
+	Type   string             `json:"type"`
+	TTLMs  int64              `json:"ttlMs,omitempty"`
+	String string             `json:"string,omitempty"`
+	Hash   map[string]string  `json:"hash,omitempty"`
+	Set    []string           `json:"set,omitempty"`
+	List   []string           `json:"list,omitempty"`
+	ZSet   map[string]float64 `json:"zset,omitempty"`
+}
+
+type KeyDiff struct {
+	Key    string   `json:"key"`
+	Action string   `json:"action"` // create, update, unchanged
+	Old    *KeyDump `json:"old,omitempty"`
+	New    *KeyDump `json:"new"`
+}
+
+// DumpKeys exporta todas as chaves do pattern (string, hash, set, list e zset).
+func (c *RedisClient) DumpKeys(ctx context.Context, pattern string) ([]KeyDump, error) {
+	keys := c.Scan(pattern)
+	sort.Strings(keys)
+
+	ret := []KeyDump{}
+	for _, key := range keys {
+		dump, found, err := c.dumpKey(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			ret = append(ret, dump)
+		}
+	}
+	return ret, nil
+}
+
+func (c *RedisClient) dumpKey(ctx context.Context, key string) (KeyDump, bool, error) {
+	dump := KeyDump{Key: key}
+
+	keyType, err := c.ServerClient.Type(ctx, key).Result()
+	if err != nil {
+		return dump, false, fmt.Errorf("type %v: %v", key, err)
+	}
+	dump.Type = keyType
+
+	switch keyType {
+	case "none":
+		return dump, false, nil
+	case "string":
+		dump.String, err = c.ServerClient.Get(ctx, key).Result()
+	case "hash":
+		dump.Hash, err = c.ServerClient.HGetAll(ctx, key).Result()
+	case "set":
+		dump.Set, err = c.ServerClient.SMembers(ctx, key).Result()
+		sort.Strings(dump.Set)
+	case "list":
+		dump.List, err = c.ServerClient.LRange(ctx, key, 0, -1).Result()
+	case "zset":
+		var members []redis.Z
+		members, err = c.ServerClient.ZRangeWithScores(ctx, key, 0, -1).Result()
+		dump.ZSet = map[string]float64{}
+		for _, member := range members {
+			dump.ZSet[fmt.Sprint(member.Member)] = member.Score
+		}
+	default:
+		return dump, false, fmt.Errorf("unsupported type %v for key %v", keyType, key)
+	}
+	if err == redis.Nil {
+		return dump, false, nil
+	} else if err != nil {
+		return dump, false, fmt.Errorf("dump %v: %v", key, err)
+	}
+
+	ttl, err := c.ServerClient.PTTL(ctx, key).Result()
+	if err != nil {
+		return dump, false, fmt.Errorf("pttl %v: %v", key, err)
+	}
+	if ttl > 0 {
+		dump.TTLMs = ttl.Milliseconds()
+	}
+
+	return dump, true, nil
+}
+
+// DiffKeys compara as chaves exportadas com o que existe hoje no Redis.
+func (c *RedisClient) DiffKeys(ctx context.Context, dumps []KeyDump) ([]KeyDiff, error) {
+	ret := []KeyDiff{}
+	for i := range dumps {
+		dump := dumps[i]
+		current, found, err := c.dumpKey(ctx, dump.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		diff := KeyDiff{Key: dump.Key, New: &dump}
+		switch {
+		case !found:
+			diff.Action = "create"
+		case sameKeyValue(current, dump):
+			diff.Action = "unchanged"
+			diff.Old = &current
+		default:
+			diff.Action = "update"
+			diff.Old = &current
+		}
+		ret = append(ret, diff)
+	}
+	return ret, nil
+}
+
+// RestoreKeys grava as chaves exportadas que mudaram. Com dryRun so retorna o diff.
+func (c *RedisClient) RestoreKeys(ctx context.Context, dumps []KeyDump, dryRun bool) ([]KeyDiff, error) {
+	diffs, err := c.DiffKeys(ctx, dumps)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return diffs, nil
+	}
+
+	for _, diff := range diffs {
+		if diff.Action == "unchanged" {
+			continue
+		}
+		if err := c.restoreKey(ctx, *diff.New); err != nil {
+			return diffs, err
+		}
+		c.InvalidateNearCache(ctx, diff.Key)
+	}
+	return diffs, nil
+}
+
+func (c *RedisClient) restoreKey(ctx context.Context, dump KeyDump) error {
+	_, err := c.ServerClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, dump.Key)
+		switch dump.Type {
+		case "string":
+			pipe.Set(ctx, dump.Key, dump.String, 0)
+		case "hash":
+			if len(dump.Hash) > 0 {
+				pipe.HSet(ctx, dump.Key, dump.Hash)
+			}
+		case "set":
+			if len(dump.Set) > 0 {
+				pipe.SAdd(ctx, dump.Key, toInterfaces(dump.Set)...)
+			}
+		case "list":
+			if len(dump.List) > 0 {
+				pipe.RPush(ctx, dump.Key, toInterfaces(dump.List)...)
+			}
+		case "zset":
+			members := []redis.Z{}
+			for member, score := range dump.ZSet {
+				members = append(members, redis.Z{Score: score, Member: member})
+			}
+			if len(members) > 0 {
+				pipe.ZAdd(ctx, dump.Key, members...)
+			}
+		default:
+			return fmt.Errorf("unsupported type %v for key %v", dump.Type, dump.Key)
+		}
+		if dump.TTLMs > 0 {
+			pipe.PExpire(ctx, dump.Key, time.Duration(dump.TTLMs)*time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("restore %v: %v", dump.Key, err)
+	}
+	return nil
+}
+
+// sameKeyValue compara tipo e conteudo, ignorando o TTL.
+func sameKeyValue(a KeyDump, b KeyDump) bool {
+	a.TTLMs, b.TTLMs = 0, 0
+	return reflect.DeepEqual(normalizeDump(a), normalizeDump(b))
+}
+
+func normalizeDump(dump KeyDump) KeyDump {
+	if len(dump.Hash) == 0 {
+		dump.Hash = nil
+	}
+	if len(dump.Set) == 0 {
+		dump.Set = nil
+	} else {
+		dump.Set = append([]string{}, dump.Set...)
+		sort.Strings(dump.Set)
+	}
+	if len(dump.List) == 0 {
+		dump.List = nil
+	}
+	if len(dump.ZSet) == 0 {
+		dump.ZSet = nil
+	}
+	return dump
+}
+
+func toInterfaces(values []string) []interface{} {
+	ret := make([]interface{}, len(values))
+	for i, value := range values {
+		ret[i] = value
+	}
+	return ret
+}
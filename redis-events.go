@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// EventCodec serializa os payloads guardados no EventLog.
+type EventCodec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type GobCodec struct{}
+
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// EventLog guarda eventos por device em sorted sets com score = timestamp (ms).
+// Cada escrita apaga os eventos mais antigos que MaxAge e mantem no maximo MaxLen eventos.
+type EventLog struct {
+	Redis  *RedisClient
+	Name   string
+	Codec  EventCodec
+	MaxAge time.Duration
+	MaxLen int64
+}
+
+type Event struct {
+	Timestamp time.Time
+	Payload   []byte
+	codec     EventCodec
+}
+
+// Decode desserializa o payload em v com o codec do EventLog.
+func (e Event) Decode(v interface{}) error {
+	return e.codec.Decode(e.Payload, v)
+}
+
+func (c *RedisClient) GetEventLog(name string, codec EventCodec, maxAge time.Duration, maxLen int64) *EventLog {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &EventLog{
+		Redis:  c,
+		Name:   name,
+		Codec:  codec,
+		MaxAge: maxAge,
+		MaxLen: maxLen,
+	}
+}
+
+func (l *EventLog) key(deviceID string) string {
+	return fmt.Sprintf("evt_%v_%v", l.Name, deviceID)
+}
+
+func (l *EventLog) Append(ctx context.Context, deviceID string, ts time.Time, event interface{}) error {
+	payload, err := l.Codec.Encode(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+
+	// o membro precisa ser unico, senao eventos iguais se sobrescrevem
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate event id: %v", err)
+	}
+	member := fmt.Sprintf("%d-%s|%s", ts.UnixNano(), hex.EncodeToString(nonce), payload)
+
+	key := l.key(deviceID)
+	_, err = l.Redis.ServerClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(ts.UnixMilli()), Member: member})
+		if l.MaxAge > 0 {
+			minScore := time.Now().Add(-l.MaxAge).UnixMilli()
+			pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(minScore, 10))
+			pipe.Expire(ctx, key, l.MaxAge)
+		}
+		if l.MaxLen > 0 {
+			pipe.ZRemRangeByRank(ctx, key, 0, -l.MaxLen-1)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append event: %v", err)
+	}
+	return nil
+}
+
+// Range retorna os eventos entre from e to, do mais antigo para o mais novo.
+func (l *EventLog) Range(ctx context.Context, deviceID string, from time.Time, to time.Time) ([]Event, error) {
+	res, err := l.Redis.ServerClient.ZRangeByScore(ctx, l.key(deviceID), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %v", err)
+	}
+	return l.parseMembers(res)
+}
+
+// RevRange retorna os eventos entre from e to, do mais novo para o mais antigo,
+// pulando offset eventos e retornando no maximo count (count <= 0 e sem limite).
+func (l *EventLog) RevRange(ctx context.Context, deviceID string, from time.Time, to time.Time, offset int64, count int64) ([]Event, error) {
+	if count <= 0 {
+		// LIMIT offset 0 nao retorna nada; -1 e sem limite
+		count = -1
+	}
+	res, err := l.Redis.ServerClient.ZRevRangeByScore(ctx, l.key(deviceID), &redis.ZRangeBy{
+		Min:    strconv.FormatInt(from.UnixMilli(), 10),
+		Max:    strconv.FormatInt(to.UnixMilli(), 10),
+		Offset: offset,
+		Count:  count,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %v", err)
+	}
+	return l.parseMembers(res)
+}
+
+// Last retorna os n eventos mais recentes do device, do mais novo para o mais antigo.
+// Com n <= 0 retorna vazio.
+func (l *EventLog) Last(ctx context.Context, deviceID string, n int64) ([]Event, error) {
+	if n <= 0 {
+		return []Event{}, nil
+	}
+	res, err := l.Redis.ServerClient.ZRevRange(ctx, l.key(deviceID), 0, n-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %v", err)
+	}
+	return l.parseMembers(res)
+}
+
+func (l *EventLog) Count(ctx context.Context, deviceID string) (int64, error) {
+	return l.Redis.ServerClient.ZCard(ctx, l.key(deviceID)).Result()
+}
+
+func (l *EventLog) Clear(ctx context.Context, deviceID string) error {
+	return l.Redis.ServerClient.Del(ctx, l.key(deviceID)).Err()
+}
+
+func (l *EventLog) parseMembers(members []string) ([]Event, error) {
+	ret := make([]Event, 0, len(members))
+	for _, member := range members {
+		sep := strings.IndexByte(member, '|')
+		dash := strings.IndexByte(member, '-')
+		if sep < 0 || dash < 0 || dash > sep {
+			return nil, fmt.Errorf("invalid event member: %q", member)
+		}
+		nanos, err := strconv.ParseInt(member[:dash], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event timestamp: %v", err)
+		}
+		ret = append(ret, Event{
+			Timestamp: time.Unix(0, nanos),
+			Payload:   []byte(member[sep+1:]),
+			codec:     l.Codec,
+		})
+	}
+	return ret, nil
+}
@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// overhead aproximado de cada entrada (elemento da lista, entrada do map, struct)
+const nearCacheEntryOverhead = 128
+
+// quanto tempo servir direto do cache (stale) depois de uma falha de conexao com o Redis
+const nearCacheOfflineBackoff = 2 * time.Second
+
+// NearCache e um LRU em memoria na frente das leituras do RedisClient.
+// Entradas expiram pelo TTL e sao invalidadas entre replicas via pub/sub do Redis.
+type NearCache struct {
+	MaxEntries int
+	MaxBytes   int64
+	TTL        time.Duration
+
+	mu           sync.Mutex
+	ll           *list.List
+	items        map[string]*list.Element
+	bytes        int64
+	offlineUntil time.Time
+	// incrementado a cada Invalidate/Purge, ver getBytes
+	generation uint64
+
+	hits   int64
+	misses int64
+	stale  int64
+}
+
+type nearCacheEntry struct {
+	key     string
+	value   []byte
+	found   bool
+	expires time.Time
+}
+
+func NewNearCache(maxEntries int, maxBytes int64, ttl time.Duration) *NearCache {
+	return &NearCache{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		TTL:        ttl,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// get retorna a entrada e se ela ainda esta dentro do TTL.
+func (nc *NearCache) get(key string) (*nearCacheEntry, bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	el, found := nc.items[key]
+	if !found {
+		nc.misses++
+		return nil, false
+	}
+	nc.ll.MoveToFront(el)
+	entry := el.Value.(*nearCacheEntry)
+	fresh := time.Now().Before(entry.expires)
+	if fresh {
+		nc.hits++
+	} else {
+		nc.misses++
+	}
+	return entry, fresh
+}
+
+// currentGeneration e lido antes do GET no Redis e passado para o put.
+func (nc *NearCache) currentGeneration() uint64 {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.generation
+}
+
+// put guarda o valor lido do Redis. Se houve alguma invalidacao desde generation o valor
+// pode ser anterior a ela e nao e guardado.
+func (nc *NearCache) put(key string, value []byte, found bool, generation uint64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if generation != nc.generation {
+		return
+	}
+
+	entry := &nearCacheEntry{key: key, value: value, found: found, expires: time.Now().Add(nc.TTL)}
+	if el, ok := nc.items[key]; ok {
+		nc.bytes -= entrySize(el.Value.(*nearCacheEntry))
+		el.Value = entry
+		nc.ll.MoveToFront(el)
+	} else {
+		nc.items[key] = nc.ll.PushFront(entry)
+	}
+	nc.bytes += entrySize(entry)
+
+	for nc.ll.Len() > 0 && ((nc.MaxEntries > 0 && nc.ll.Len() > nc.MaxEntries) || (nc.MaxBytes > 0 && nc.bytes > nc.MaxBytes)) {
+		nc.removeElement(nc.ll.Back())
+	}
+}
+
+func (nc *NearCache) Invalidate(key string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.generation++
+	if el, found := nc.items[key]; found {
+		nc.removeElement(el)
+	}
+}
+
+func (nc *NearCache) Purge() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.generation++
+	nc.ll.Init()
+	nc.items = map[string]*list.Element{}
+	nc.bytes = 0
+}
+
+func (nc *NearCache) Len() int {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.ll.Len()
+}
+
+func (nc *NearCache) Stats() (hits int64, misses int64, stale int64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.hits, nc.misses, nc.stale
+}
+
+func (nc *NearCache) removeElement(el *list.Element) {
+	entry := nc.ll.Remove(el).(*nearCacheEntry)
+	delete(nc.items, entry.key)
+	nc.bytes -= entrySize(entry)
+}
+
+func (nc *NearCache) offline() bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return time.Now().Before(nc.offlineUntil)
+}
+
+func (nc *NearCache) setOffline() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.offlineUntil = time.Now().Add(nearCacheOfflineBackoff)
+}
+
+func (nc *NearCache) markStale() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.stale++
+}
+
+func entrySize(entry *nearCacheEntry) int64 {
+	return int64(len(entry.key) + len(entry.value) + nearCacheEntryOverhead)
+}
+
+// As chaves (ex: cfg_*) nao tem o ambiente no nome, entao o canal tambem nao: assim um
+// processo com outro -env (ex: redis-inspect import) invalida as mesmas chaves.
+const nearCacheChannel = "nearcache_invalidate"
+
+// EnableNearCache liga o cache local para Get, GetInt, GetBin e os GetConfig*.
+// Liga tambem o PublishInvalidations, para Set e Del deste processo invalidarem as outras
+// replicas. RestoreKeys sempre invalida.
+func (c *RedisClient) EnableNearCache(maxEntries int, maxBytes int64, ttl time.Duration) error {
+	ctx := context.Background()
+
+	sub := c.ServerClient.Subscribe(ctx, nearCacheChannel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return fmt.Errorf("failed to subscribe to invalidation channel: %v", err)
+	}
+
+	c.NearCache = NewNearCache(maxEntries, maxBytes, ttl)
+	c.nearCacheSub = sub
+	c.PublishInvalidations = true
+
+	go c.listenNearCacheInvalidations(sub, c.NearCache)
+
+	log.Info("Near cache ok.", maxEntries, maxBytes, ttl)
+	return nil
+}
+
+func (c *RedisClient) listenNearCacheInvalidations(sub *redis.PubSub, nc *NearCache) {
+	ctx := context.Background()
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			if err == redis.ErrClosed {
+				return
+			}
+			time.Sleep(nearCacheOfflineBackoff)
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// reconectou: invalidacoes podem ter sido perdidas
+			nc.Purge()
+		case *redis.Message:
+			if msg.Payload == "*" {
+				nc.Purge()
+			} else {
+				nc.Invalidate(msg.Payload)
+			}
+		}
+	}
+}
+
+// InvalidateNearCache remove a chave do cache local de todas as replicas ("*" limpa tudo).
+// Publica a invalidacao mesmo sem near cache ligado neste processo (ex: redis-inspect
+// import). Escritas direto no ServerClient precisam chamar isso, senao as replicas so
+// veem o valor novo depois do TTL.
+func (c *RedisClient) InvalidateNearCache(ctx context.Context, key string) error {
+	if nc := c.NearCache; nc != nil {
+		if key == "*" {
+			nc.Purge()
+		} else {
+			nc.Invalidate(key)
+		}
+	}
+	return c.ServerClient.Publish(ctx, nearCacheChannel, key).Err()
+}
+
+// invalidateOnWrite e chamado pelo Set e Del. So publica com PublishInvalidations, para
+// nao custar um round-trip a mais em cada escrita de quem nao usa near cache.
+func (c *RedisClient) invalidateOnWrite(ctx context.Context, key string) {
+	if c.PublishInvalidations {
+		c.InvalidateNearCache(ctx, key)
+	} else if nc := c.NearCache; nc != nil {
+		nc.Invalidate(key)
+	}
+}
+
+// getBytes le a chave passando pelo near cache quando ele esta ligado.
+// Se o Redis estiver fora, devolve o valor vencido que estiver no cache.
+func (c *RedisClient) getBytes(ctx context.Context, key string) ([]byte, bool, error) {
+	nc := c.NearCache
+	if nc == nil {
+		val, err := c.ServerClient.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil, false, nil
+		}
+		return val, err == nil, err
+	}
+
+	entry, fresh := nc.get(key)
+	if fresh {
+		return entry.value, entry.found, nil
+	}
+	if entry != nil && nc.offline() {
+		nc.markStale()
+		return entry.value, entry.found, nil
+	}
+
+	// uma invalidacao que chegar entre o GET e o put descarta o valor lido
+	generation := nc.currentGeneration()
+	val, err := c.ServerClient.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		nc.put(key, nil, false, generation)
+		return nil, false, nil
+	}
+	if err != nil {
+		nc.setOffline()
+		if entry != nil {
+			nc.markStale()
+			log.Debug("Near cache stale", key, err)
+			return entry.value, entry.found, nil
+		}
+		return nil, false, err
+	}
+
+	nc.put(key, val, true, generation)
+	return val, true, nil
+}
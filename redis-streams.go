@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Broker em cima de Redis Streams:
+
+	- cada topico e o stream stream_<topico>, cada subscription e um consumer group nele;
+	- mensagens com erro ficam pendentes (sem XACK) e sao reentregues pelo XAUTOCLAIM
+	  depois de RedeliveryDelay, para qualquer consumidor do grupo;
+	- o ID da mensagem e o ID do stream (<ms>-<seq>).
+*/
+
+const (
+	streamFieldData        = "data"
+	streamFieldAttributes  = "attributes"
+	streamFieldOrderingKey = "orderingKey"
+)
+
+type RedisStreamBroker struct {
+	Redis *RedisClient
+	// Tamanho aproximado maximo de cada stream (0 = sem limite). Mensagens cortadas
+	// do stream nao sao entregues, mesmo que alguma subscription ainda nao tenha lido.
+	MaxLen int64
+	// Nome deste consumidor nos grupos (default <hostname>-<pid>).
+	Consumer string
+	// Quanto tempo uma mensagem com erro (ou de um consumidor que morreu) espera para ser reentregue.
+	RedeliveryDelay time.Duration
+	// Quanto tempo cada leitura fica bloqueada esperando mensagens novas.
+	BlockTimeout time.Duration
+	// Mensagens buscadas por leitura.
+	BatchSize int64
+}
+
+func NewRedisStreamBroker(c *RedisClient) *RedisStreamBroker {
+	hostname, _ := os.Hostname()
+	return &RedisStreamBroker{
+		Redis:           c,
+		Consumer:        fmt.Sprintf("%v-%v", hostname, os.Getpid()),
+		RedeliveryDelay: 30 * time.Second,
+		BlockTimeout:    time.Second,
+		BatchSize:       10,
+	}
+}
+
+func streamKey(topic string) string {
+	return fmt.Sprintf("stream_%v", topic)
+}
+
+func (b *RedisStreamBroker) Publish(ctx context.Context, topic string, msg Message) (string, error) {
+	values := map[string]interface{}{
+		streamFieldData: msg.Data,
+	}
+	if len(msg.Attributes) > 0 {
+		attributes, err := json.Marshal(msg.Attributes)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode attributes: %v", err)
+		}
+		values[streamFieldAttributes] = attributes
+	}
+	if msg.OrderingKey != "" {
+		values[streamFieldOrderingKey] = msg.OrderingKey
+	}
+
+	args := &redis.XAddArgs{
+		Stream: streamKey(topic),
+		Values: values,
+	}
+	if b.MaxLen > 0 {
+		args.MaxLen = b.MaxLen
+		args.Approx = true
+	}
+	id, err := b.Redis.ServerClient.XAdd(ctx, args).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to publish to %v: %v", topic, err)
+	}
+	return id, nil
+}
+
+func (b *RedisStreamBroker) CreateSubscription(ctx context.Context, topic string, subscription string) error {
+	err := b.Redis.ServerClient.XGroupCreateMkStream(ctx, streamKey(topic), subscription, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create group %v: %v", subscription, err)
+	}
+	return nil
+}
+
+// Subscribe processa as mensagens uma por vez; para consumir em paralelo chame Subscribe
+// em varias goroutines.
+func (b *RedisStreamBroker) Subscribe(ctx context.Context, topic string, subscription string, handler MessageHandler) error {
+	if err := b.CreateSubscription(ctx, topic, subscription); err != nil {
+		return err
+	}
+
+	// mesmo esquema do receive do Pub/Sub: o handler em andamento termina no shutdown
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := streamKey(topic)
+	log.Info("Consuming", key, subscription)
+	for ctx.Err() == nil {
+		claimed, _, err := b.Redis.ServerClient.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   key,
+			Group:    subscription,
+			Consumer: b.Consumer,
+			MinIdle:  b.RedeliveryDelay,
+			Start:    "0-0",
+			Count:    b.BatchSize,
+		}).Result()
+		if err != nil && ctx.Err() == nil {
+			log.Warn("Subscribe - erro no XAUTOCLAIM ", key, subscription, err)
+		}
+		for _, xmsg := range claimed {
+			b.handle(handlerCtx, key, subscription, xmsg, true, handler)
+		}
+
+		streams, err := b.Redis.ServerClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    subscription,
+			Consumer: b.Consumer,
+			Streams:  []string{key, ">"},
+			Count:    b.BatchSize,
+			Block:    b.BlockTimeout,
+		}).Result()
+		if err == redis.Nil || ctx.Err() != nil {
+			continue
+		} else if err != nil {
+			log.Warn("Subscribe - erro no XREADGROUP ", key, subscription, err)
+			time.Sleep(b.BlockTimeout)
+			continue
+		}
+		for _, stream := range streams {
+			for _, xmsg := range stream.Messages {
+				b.handle(handlerCtx, key, subscription, xmsg, false, handler)
+			}
+		}
+	}
+	log.Info("Consume stopped", key, subscription)
+	return nil
+}
+
+func (b *RedisStreamBroker) handle(ctx context.Context, key string, subscription string, xmsg redis.XMessage, redelivered bool, handler MessageHandler) {
+	if xmsg.Values == nil {
+		// cortada do stream (MaxLen) enquanto estava pendente
+		b.Redis.ServerClient.XAck(ctx, key, subscription, xmsg.ID)
+		return
+	}
+
+	msg, err := messageFromStream(xmsg)
+	if err != nil {
+		log.Error("Subscribe - descartando mensagem ", key, xmsg.ID, err)
+		b.Redis.ServerClient.XAck(ctx, key, subscription, xmsg.ID)
+		return
+	}
+	msg.Subscription = subscription
+	msg.DeliveryAttempt = 1
+	if redelivered {
+		msg.DeliveryAttempt = b.deliveryCount(ctx, key, subscription, xmsg.ID)
+	}
+
+	if err := callHandler(ctx, handler, msg); err != nil {
+		log.Warn("Subscribe - nack ", key, msg.ID, err)
+		return
+	}
+	if err := b.Redis.ServerClient.XAck(ctx, key, subscription, xmsg.ID).Err(); err != nil {
+		log.Warn("Subscribe - erro no XACK ", key, msg.ID, err)
+	}
+}
+
+func (b *RedisStreamBroker) deliveryCount(ctx context.Context, key string, subscription string, id string) int {
+	pending, err := b.Redis.ServerClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: key,
+		Group:  subscription,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 0
+	}
+	return int(pending[0].RetryCount)
+}
+
+func messageFromStream(xmsg redis.XMessage) (Message, error) {
+	msg := Message{ID: xmsg.ID}
+
+	if ms, err := strconv.ParseInt(strings.SplitN(xmsg.ID, "-", 2)[0], 10, 64); err == nil {
+		msg.PublishTime = time.UnixMilli(ms)
+	}
+	if data, ok := xmsg.Values[streamFieldData].(string); ok {
+		msg.Data = []byte(data)
+	}
+	if attributes, ok := xmsg.Values[streamFieldAttributes].(string); ok {
+		if err := json.Unmarshal([]byte(attributes), &msg.Attributes); err != nil {
+			return msg, fmt.Errorf("failed to decode attributes: %v", err)
+		}
+	}
+	if orderingKey, ok := xmsg.Values[streamFieldOrderingKey].(string); ok {
+		msg.OrderingKey = orderingKey
+	}
+	return msg, nil
+}
+
+func (b *RedisStreamBroker) Close() {
+	b.Redis.Close()
+}
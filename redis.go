@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/gob"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/bsm/redislock"
@@ -17,19 +18,35 @@ type RedisClient struct {
 	Environment  string
 	Host         string
 	Locker       *redislock.Client
+	NearCache    *NearCache
+	// Set e Del publicam a invalidacao do near cache para as outras replicas. Ligado pelo
+	// EnableNearCache; processos que so escrevem em chaves lidas com near cache precisam ligar.
+	PublishInvalidations bool
+	nearCacheSub         *redis.PubSub
 }
 
 func GetRedisClient(serverURL string, env string, connectionPoolSize int) *RedisClient {
+	client, err := NewRedisClient(serverURL, env, connectionPoolSize)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// NewRedisClient e como o GetRedisClient, mas retorna erro em vez de panic se o Redis nao responder.
+func NewRedisClient(serverURL string, env string, connectionPoolSize int) (*RedisClient, error) {
 	client := RedisClient{}
 
 	client.Environment = env
 	client.Host = serverURL
 
-	client.connect(connectionPoolSize)
-	return &client
+	if err := client.connect(connectionPoolSize); err != nil {
+		return nil, err
+	}
+	return &client, nil
 }
 
-func (c *RedisClient) connect(connectionPoolSize int) {
+func (c *RedisClient) connect(connectionPoolSize int) error {
 
 	ctx := context.Background()
 
@@ -42,21 +59,27 @@ func (c *RedisClient) connect(connectionPoolSize int) {
 	})
 	pong, err := c.ServerClient.Ping(ctx).Result()
 	if err != nil {
-		panic(err)
+		c.ServerClient.Close()
+		return err
 	}
 	log.Info("Redis ok: ", pong)
 
 	// Create a new lock client.
 	c.Locker = redislock.New(c.ServerClient)
+	return nil
 }
 
 func (c *RedisClient) Close() {
+	if c.nearCacheSub != nil {
+		c.nearCacheSub.Close()
+	}
 	c.ServerClient.Close()
 }
 
 func (c *RedisClient) Del(key string) {
 	ctx := context.Background()
 	c.ServerClient.Del(ctx, key)
+	c.invalidateOnWrite(ctx, key)
 }
 
 func (c *RedisClient) RPush(ctx context.Context, key string, values ...interface{}) error {
@@ -76,6 +99,7 @@ func (c *RedisClient) LPush(ctx context.Context, key string, values ...interface
 func (c *RedisClient) Set(key string, value interface{}, expTime time.Duration) {
 	ctx := context.Background()
 	c.ServerClient.Set(ctx, key, value, expTime)
+	c.invalidateOnWrite(ctx, key)
 }
 
 func (c *RedisClient) HMSet(key string, fields map[string]interface{}) {
@@ -126,9 +150,8 @@ func (c *RedisClient) LLen(ctx context.Context, key string) (int64, error) {
 
 func (c *RedisClient) GetBin(key string) []byte {
 	ctx := context.Background()
-	val := c.ServerClient.Get(ctx, key)
-	buffer, err := val.Bytes()
-	if err != nil {
+	buffer, found, err := c.getBytes(ctx, key)
+	if err != nil || !found {
 		log.Debug("GetBin", key, err)
 		return nil
 	}
@@ -137,14 +160,18 @@ func (c *RedisClient) GetBin(key string) []byte {
 
 func (c *RedisClient) Get(key string) string {
 	ctx := context.Background()
-	res := c.ServerClient.Get(ctx, key)
-	return res.Val()
+	res, _, _ := c.getBytes(ctx, key)
+	return string(res)
 }
 
 func (c *RedisClient) GetInt(key string) int64 {
 	ctx := context.Background()
-	res := c.ServerClient.Get(ctx, key)
-	val, err := res.Int64()
+	res, _, err := c.getBytes(ctx, key)
+	if err != nil {
+		log.Debug("GetInt", key, err)
+		return 0
+	}
+	val, err := strconv.ParseInt(string(res), 10, 64)
 	if err != nil {
 		log.Debug("GetInt", key, err)
 		val = 0
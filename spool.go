@@ -0,0 +1,377 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Spool em disco para store-and-forward: fila FIFO persistente em arquivos de segmento
+	append-only (<seq>.seg), lidos em ordem pelo forwarder.
+
+	Cada registro e | 4 bytes tamanho | 4 bytes crc32 | JSON do SpoolRecord |.
+	A posicao de leitura fica no arquivo cursor ("<seq> <offset>"); segmentos lidos
+	ate o fim sao apagados. Um registro cortado no fim do ultimo segmento (queda no
+	meio da escrita) e descartado na abertura.
+*/
+
+const (
+	spoolHeaderSize     = 8
+	spoolSegmentExt     = ".seg"
+	spoolCursorFile     = "cursor"
+	defaultSegmentBytes = 4 * 1024 * 1024
+)
+
+var ErrSpoolFull = errors.New("spool full")
+
+type SpoolRecord struct {
+	Topic       string            `json:"topic"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	Time        time.Time         `json:"time"`
+}
+
+type Spool struct {
+	Dir string
+	// Tamanho maximo dos registros pendentes; acima disso o Append retorna ErrSpoolFull.
+	MaxBytes     int64
+	SegmentBytes int64
+	// Opcional, recebe "pubsub_spool_messages" e "pubsub_spool_bytes" a cada mudanca.
+	Metrics GaugeRecorder
+
+	mu         sync.Mutex
+	segments   []int64
+	writer     *os.File
+	writeSize  int64
+	readOffset int64
+	reader     *os.File
+	peekedSize int64
+	count      int64
+	bytes      int64
+	notify     chan struct{}
+}
+
+// OpenSpool abre (ou cria) o spool no diretorio, recuperando os registros pendentes.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool dir: %v", err)
+	}
+	s := &Spool{
+		Dir:          dir,
+		MaxBytes:     maxBytes,
+		SegmentBytes: defaultSegmentBytes,
+		notify:       make(chan struct{}, 1),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) segmentPath(seq int64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%020d%v", seq, spoolSegmentExt))
+}
+
+// recover le os segmentos e o cursor e conta os registros pendentes.
+func (s *Spool) recover() error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool dir: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	cursorSeq, cursorOffset := s.readCursor()
+	// segmentos anteriores ao cursor ja foram lidos
+	for len(s.segments) > 0 && s.segments[0] < cursorSeq {
+		os.Remove(s.segmentPath(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0] == cursorSeq {
+		s.readOffset = cursorOffset
+	}
+
+	for i, seq := range s.segments {
+		start := int64(0)
+		if i == 0 {
+			start = s.readOffset
+		}
+		count, end, err := scanSegment(s.segmentPath(seq), start)
+		if err != nil {
+			return err
+		}
+		s.count += count
+		s.bytes += end - start
+		if i == len(s.segments)-1 {
+			// descarta o registro incompleto do fim
+			if err := os.Truncate(s.segmentPath(seq), end); err != nil {
+				return fmt.Errorf("failed to truncate spool segment: %v", err)
+			}
+		}
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = []int64{cursorSeq + 1}
+		s.readOffset = 0
+	}
+	return s.openWriter(s.segments[len(s.segments)-1])
+}
+
+func (s *Spool) readCursor() (int64, int64) {
+	data, err := os.ReadFile(filepath.Join(s.Dir, spoolCursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	var seq, offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return 0, 0
+	}
+	return seq, offset
+}
+
+func (s *Spool) writeCursor() error {
+	path := filepath.Join(s.Dir, spoolCursorFile)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d", s.segments[0], s.readOffset)
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return fmt.Errorf("failed to write spool cursor: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// scanSegment conta os registros validos a partir de start e retorna onde eles terminam.
+func scanSegment(path string, start int64) (int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("failed to read spool segment: %v", err)
+	}
+	count, offset := int64(0), start
+	for {
+		_, size, err := readSpoolRecord(f)
+		if err != nil {
+			return count, offset, nil
+		}
+		count++
+		offset += size
+	}
+}
+
+func readSpoolRecord(r io.Reader) (SpoolRecord, int64, error) {
+	rec := SpoolRecord{}
+	header := make([]byte, spoolHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return rec, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return rec, 0, fmt.Errorf("spool record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, fmt.Errorf("invalid spool record: %v", err)
+	}
+	return rec, int64(spoolHeaderSize + length), nil
+}
+
+func (s *Spool) openWriter(seq int64) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat spool segment: %v", err)
+	}
+	s.writer = f
+	s.writeSize = info.Size()
+	return nil
+}
+
+// Append grava o registro no fim do spool (com fsync).
+func (s *Spool) Append(rec SpoolRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode spool record: %v", err)
+	}
+	buf := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[spoolHeaderSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		return fmt.Errorf("spool closed")
+	}
+	if s.MaxBytes > 0 && s.bytes+int64(len(buf)) > s.MaxBytes {
+		return ErrSpoolFull
+	}
+
+	if s.writeSize > 0 && s.writeSize+int64(len(buf)) > s.SegmentBytes {
+		// segmento cheio, comeca outro
+		seq := s.segments[len(s.segments)-1] + 1
+		s.writer.Close()
+		if err := s.openWriter(seq); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seq)
+	}
+
+	if _, err := s.writer.Write(buf); err != nil {
+		return fmt.Errorf("failed to write spool: %v", err)
+	}
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool: %v", err)
+	}
+	s.writeSize += int64(len(buf))
+	s.count++
+	s.bytes += int64(len(buf))
+	s.reportMetrics()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek retorna o registro mais antigo sem remover. O segundo retorno e false se o spool estiver vazio.
+func (s *Spool) Peek() (SpoolRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.count > 0 {
+		if s.reader == nil {
+			f, err := os.Open(s.segmentPath(s.segments[0]))
+			if err != nil {
+				return SpoolRecord{}, false, fmt.Errorf("failed to open spool segment: %v", err)
+			}
+			if _, err := f.Seek(s.readOffset, io.SeekStart); err != nil {
+				f.Close()
+				return SpoolRecord{}, false, fmt.Errorf("failed to read spool segment: %v", err)
+			}
+			s.reader = f
+		}
+
+		rec, size, err := readSpoolRecord(s.reader)
+		if err == nil {
+			// volta para reler o mesmo registro se nao houver Commit
+			if _, err := s.reader.Seek(-size, io.SeekCurrent); err != nil {
+				return SpoolRecord{}, false, fmt.Errorf("failed to read spool segment: %v", err)
+			}
+			s.peekedSize = size
+			return rec, true, nil
+		}
+		if len(s.segments) == 1 {
+			return SpoolRecord{}, false, fmt.Errorf("failed to read spool: %v", err)
+		}
+
+		// fim do segmento (ou registro corrompido, que o recover ja nao contou), passa para o proximo
+		s.reader.Close()
+		s.reader = nil
+		os.Remove(s.segmentPath(s.segments[0]))
+		s.segments = s.segments[1:]
+		s.readOffset = 0
+		if err := s.writeCursor(); err != nil {
+			return SpoolRecord{}, false, err
+		}
+	}
+	return SpoolRecord{}, false, nil
+}
+
+// Commit remove o registro retornado pelo ultimo Peek.
+func (s *Spool) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peekedSize == 0 {
+		return fmt.Errorf("spool commit without peek")
+	}
+	if _, err := s.reader.Seek(s.peekedSize, io.SeekCurrent); err != nil {
+		return fmt.Errorf("failed to read spool segment: %v", err)
+	}
+	s.readOffset += s.peekedSize
+	s.count--
+	s.bytes -= s.peekedSize
+	s.peekedSize = 0
+	s.reportMetrics()
+	return s.writeCursor()
+}
+
+// Len retorna quantos registros estao pendentes.
+func (s *Spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Bytes retorna o tamanho dos registros pendentes.
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Notify recebe um sinal quando um registro e gravado.
+func (s *Spool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+func (s *Spool) reportMetrics() {
+	if s.Metrics == nil {
+		return
+	}
+	labels := map[string]string{"dir": s.Dir}
+	s.Metrics.SetGauge("pubsub_spool_messages", float64(s.count), labels)
+	s.Metrics.SetGauge("pubsub_spool_bytes", float64(s.bytes), labels)
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
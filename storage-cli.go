@@ -88,6 +88,23 @@ func (c *StorageClient) Get(path string) []byte {
 }
 
 func (c *StorageClient) Save(path string, content []byte) error {
+	_, err := c.save(path, content)
+	return err
+}
+
+// SaveChecked e o Save retornando erro tambem quando o storage responde com status de erro.
+func (c *StorageClient) SaveChecked(path string, content []byte) error {
+	status, err := c.save(path, content)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("Storage - Save %v: %v %v", path, status, http.StatusText(status))
+	}
+	return nil
+}
+
+func (c *StorageClient) save(path string, content []byte) (int, error) {
 
 	client := &http.Client{}
 
@@ -98,20 +115,20 @@ func (c *StorageClient) Save(path string, content []byte) error {
 	writer := multipart.NewWriter(body)
 	part, err := writer.CreateFormFile("c", filepath.Base(path))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if _, err = part.Write(content); err != nil {
-		return err
+		return 0, err
 	}
 
 	if err = writer.WriteField("p", path); err != nil {
-		return err
+		return 0, err
 	}
 
 	err = writer.Close()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	req, err := http.NewRequest("POST", postURL, body)
@@ -119,21 +136,38 @@ func (c *StorageClient) Save(path string, content []byte) error {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("Storage - Failed to do request: %v", err)
+		return 0, fmt.Errorf("Storage - Failed to do request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("Storage - Failed to read response: %v", err)
+		return 0, fmt.Errorf("Storage - Failed to read response: %v", err)
 	}
 	log.Println("Storage - Save", resp.Status, respBody)
 
-	return nil
+	return resp.StatusCode, nil
 
 }
 
 func (c *StorageClient) Move(pathSource string, pathTarget string) error {
+	_, err := c.move(pathSource, pathTarget)
+	return err
+}
+
+// MoveChecked e o Move retornando erro tambem quando o storage responde com status de erro.
+func (c *StorageClient) MoveChecked(pathSource string, pathTarget string) error {
+	status, err := c.move(pathSource, pathTarget)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("Storage - Move %v: %v %v", pathSource, status, http.StatusText(status))
+	}
+	return nil
+}
+
+func (c *StorageClient) move(pathSource string, pathTarget string) (int, error) {
 
 	client := &http.Client{}
 
@@ -149,16 +183,42 @@ func (c *StorageClient) Move(pathSource string, pathTarget string) error {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("Storage - Failed to do request: %v", err)
+		return 0, fmt.Errorf("Storage - Failed to do request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("Storage - Failed to read response: %v", err)
+		return 0, fmt.Errorf("Storage - Failed to read response: %v", err)
 	}
 	log.Println("Storage - Move", resp.Status, respBody)
 
-	return nil
+	return resp.StatusCode, nil
+
+}
+
+// Load e o Get retornando erro quando o arquivo nao existe ou o storage falha.
+func (c *StorageClient) Load(path string) ([]byte, error) {
+
+	client := &http.Client{}
+
+	getURL := c.Host + "/v1/get?p=" + url.QueryEscape(path)
+	log.Debug("Storage - Request " + getURL)
+
+	resp, err := client.Get(getURL)
+	if err != nil {
+		return nil, fmt.Errorf("Storage - Failed to do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Storage - Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Storage - Load %v: %v", path, resp.Status)
+	}
+
+	return respBody, nil
 
 }
@@ -7,4 +7,9 @@ type Message struct {
 	Data        []byte            `json:"data"`
 	Attributes  map[string]string `json:"attributes"`
 	PublishTime time.Time         `json:"publishTime"`
+	// Numero da tentativa de entrega, so vem preenchido quando a subscription tem dead letter.
+	DeliveryAttempt int    `json:"deliveryAttempt,omitempty"`
+	OrderingKey     string `json:"orderingKey,omitempty"`
+	// Nome completo da subscription que entregou a mensagem (projects/<p>/subscriptions/<s>).
+	Subscription string `json:"subscription,omitempty"`
 }
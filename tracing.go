@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// W3C Trace Context (https://www.w3.org/TR/trace-context/), propagado nas mensagens
+// pelo atributo "traceparent".
+
+const TraceparentAttribute = "traceparent"
+
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+type traceContextKey struct{}
+
+// NewTraceContext inicia um trace novo (sampled).
+func NewTraceContext() TraceContext {
+	tc := TraceContext{Flags: 1}
+	rand.Read(tc.TraceID[:])
+	rand.Read(tc.SpanID[:])
+	return tc
+}
+
+// NewChild retorna um span novo no mesmo trace.
+func (tc TraceContext) NewChild() TraceContext {
+	child := tc
+	rand.Read(child.SpanID[:])
+	return child
+}
+
+func (tc TraceContext) TraceIDString() string {
+	return hex.EncodeToString(tc.TraceID[:])
+}
+
+func (tc TraceContext) SpanIDString() string {
+	return hex.EncodeToString(tc.SpanID[:])
+}
+
+// Traceparent formata no padrao "00-<trace-id>-<span-id>-<flags>".
+func (tc TraceContext) Traceparent() string {
+	return fmt.Sprintf("00-%v-%v-%02x", tc.TraceIDString(), tc.SpanIDString(), tc.Flags)
+}
+
+func ParseTraceparent(traceparent string) (TraceContext, error) {
+	tc := TraceContext{}
+
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil {
+		return tc, fmt.Errorf("invalid trace id: %v", err)
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil {
+		return tc, fmt.Errorf("invalid span id: %v", err)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return tc, fmt.Errorf("invalid trace flags: %v", err)
+	}
+	tc.Flags = flags[0]
+
+	if tc.TraceID == ([16]byte{}) || tc.SpanID == ([8]byte{}) {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	return tc, nil
+}
+
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}